@@ -0,0 +1,316 @@
+package imstm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen indicates that the circuit of the datastore and transaction code is open,
+// and the request is failed without being sent
+var ErrCircuitOpen = errors.New("Circuit is open")
+
+// BreakerKey identifies a circuit of the circuit breaker
+type BreakerKey struct {
+	DataStore string //ims datastore name
+	TranCode  string //ims transaction code
+}
+
+// BreakerState represents the state of a circuit
+type BreakerState int
+
+// List of circuit states
+const (
+	BreakerClosed   BreakerState = iota //requests flow normally
+	BreakerOpen                         //requests fail fast with ErrCircuitOpen
+	BreakerHalfOpen                     //limited probe requests are let through
+)
+
+var breakerStateNames = map[BreakerState]string{
+	BreakerClosed:   "Closed",
+	BreakerOpen:     "Open",
+	BreakerHalfOpen: "HalfOpen",
+}
+
+// String returns the name of the circuit state
+func (st BreakerState) String() string {
+	if str, ok := breakerStateNames[st]; ok {
+		return str
+	}
+	return "Unknown: " + strconv.Itoa(int(st))
+}
+
+// BreakerStatus represents the state of a circuit, for inspection
+type BreakerStatus struct {
+	Key      BreakerKey
+	State    BreakerState
+	Failures int       //consecutive failures
+	OpenedAt time.Time //time at which the circuit opened last
+	LastErr  error     //last failure
+}
+
+// CircuitBreaker fails the requests fast, when a transaction or datastore keeps failing.
+// The circuits are keyed by the datastore and the transaction code. Failures are the stopped
+// transactions (OTMA sense code 001A), unavailable datastores (return code 44 or reason codes
+// 72 and 74) and the connection failures.
+//
+// A CircuitBreaker can be shared by multiple contexts and sessions.
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failures that opens a circuit. Defaults to 5
+	FailureThreshold int
+
+	// OpenTimeout is the duration a circuit stays open, before probing. Defaults to 30s
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes is the number of concurrent probe requests allowed in half-open state.
+	// Defaults to 1
+	HalfOpenProbes int
+
+	mu       sync.Mutex
+	circuits map[BreakerKey]*circuit
+}
+
+// circuit is the state of a single circuit
+type circuit struct {
+	state    BreakerState
+	failures int
+	probes   int //in-flight probes in half-open state
+	openedAt time.Time
+	lastErr  error
+}
+
+// Status returns the state of all the circuits
+func (cb *CircuitBreaker) Status() []BreakerStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	var out []BreakerStatus
+	for key, c := range cb.circuits {
+		out = append(out, BreakerStatus{
+			Key:      key,
+			State:    cb.stateLocked(c),
+			Failures: c.failures,
+			OpenedAt: c.openedAt,
+			LastErr:  c.lastErr,
+		})
+	}
+	return out
+}
+
+// State returns the state of the circuit for the key
+func (cb *CircuitBreaker) State(key BreakerKey) BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if c, ok := cb.circuits[key]; ok {
+		return cb.stateLocked(c)
+	}
+	return BreakerClosed
+}
+
+// stateLocked returns the effective state, moving an expired open circuit to half-open
+func (cb *CircuitBreaker) stateLocked(c *circuit) BreakerState {
+	timeout := cb.OpenTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	if c.state == BreakerOpen && time.Since(c.openedAt) >= timeout {
+		c.state = BreakerHalfOpen
+		c.probes = 0
+	}
+	return c.state
+}
+
+// allow checks if a request can be sent for the key. The returned function must be invoked
+// with the outcome of the request.
+func (cb *CircuitBreaker) allow(key BreakerKey) (func(err error), error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.circuits == nil {
+		cb.circuits = make(map[BreakerKey]*circuit)
+	}
+	c, ok := cb.circuits[key]
+	if !ok {
+		c = &circuit{}
+		cb.circuits[key] = c
+	}
+
+	probe := false
+	switch cb.stateLocked(c) {
+	case BreakerOpen:
+		return nil, ErrCircuitOpen
+	case BreakerHalfOpen:
+		max := cb.HalfOpenProbes
+		if max <= 0 {
+			max = 1
+		}
+		if c.probes >= max {
+			return nil, ErrCircuitOpen
+		}
+		c.probes++
+		probe = true
+	}
+
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() { cb.record(c, probe, err) })
+	}, nil
+}
+
+// record updates the circuit with the outcome of a request. The errors that are neither
+// failures nor responses of IMS release the probe slot without changing the circuit.
+func (cb *CircuitBreaker) record(c *circuit, probe bool, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if probe && c.probes > 0 {
+		c.probes--
+	}
+	if !tripping(err) {
+		if (err == nil || responded(err)) && (probe || c.state == BreakerClosed) {
+			c.state = BreakerClosed
+			c.failures = 0
+		}
+		return
+	}
+	c.failures++
+	c.lastErr = err
+	threshold := cb.FailureThreshold
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if probe || c.failures >= threshold {
+		c.state = BreakerOpen
+		c.openedAt = time.Now()
+	}
+}
+
+// tripping reports whether the error counts as a failure for the circuit, i.e. a stopped
+// transaction, an unavailable datastore or a connection failure
+func tripping(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ce *IMSConnectError
+	if errors.As(err, &ce) {
+		//OTMA sense code 001A - transaction is stopped
+		return (ce.ReturnCode == 16 && ce.ReasonCode == 0x1A) || unhealthy(ce)
+	}
+	var we *WriteError
+	var ne net.Error
+	return errors.As(err, &we) || errors.As(err, &ne) || errors.Is(err, ErrDisconnected) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// responded reports whether the error is a response of IMS, which counts as a success for the
+// circuit. Any other error, like the misuse of the protocol, counts as neither.
+func responded(err error) bool {
+	var ce *IMSConnectError
+	var de *DFS2082Error
+	return errors.As(err, &ce) || errors.As(err, &de)
+}
+
+// SetCircuitBreaker sets the circuit breaker for the requests of this context.
+// Passing nil removes the circuit breaker
+func (ctx *Context) SetCircuitBreaker(cb *CircuitBreaker) *Context {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.breaker = cb
+	return ctx
+}
+
+// guard checks the circuit breaker of the context, if any, for a new request. The returned function
+// must be invoked with the outcome of the request
+func (ctx *Context) guard(proto protocol, segments [][]byte, ascii bool) (func(err error), error) {
+	ctx.mu.Lock()
+	cb := ctx.breaker
+	ctx.mu.Unlock()
+	//resume tpipe requests are not bound to a transaction
+	if cb == nil || proto == protoRecvOnly {
+		return func(error) {}, nil
+	}
+	return cb.allow(ctx.key(segments, ascii))
+}
+
+// abandon settles the outcome held for the response that will not be read, with the cause
+func (ctx *Context) abandon(cause error) {
+	ctx.settle(nil, cause)
+}
+
+// await holds the outcome function till the response of the request is complete
+func (ctx *Context) await(done func(err error)) {
+	ctx.mu.Lock()
+	prev := ctx.outcome
+	ctx.outcome = done
+	ctx.mu.Unlock()
+	if prev != nil {
+		prev(ErrResponseIncomplete)
+	}
+}
+
+// onSettled invokes fn once the response of the last request is complete or abandoned,
+// right away if no response is pending
+func (ctx *Context) onSettled(fn func()) {
+	ctx.mu.Lock()
+	done := ctx.outcome
+	if done == nil {
+		ctx.mu.Unlock()
+		fn()
+		return
+	}
+	ctx.outcome = func(err error) {
+		done(err)
+		fn()
+	}
+	ctx.mu.Unlock()
+}
+
+// settle invokes the outcome function held for the response
+func (ctx *Context) settle(r *Response, err error) {
+	ctx.mu.Lock()
+	done := ctx.outcome
+	ctx.outcome = nil
+	ctx.mu.Unlock()
+	if done == nil {
+		return
+	}
+	if err == nil {
+		err = r.statusErr()
+	}
+	done(err)
+}
+
+// key returns the datastore and the transaction code of the request.
+// If the transaction code is not set on the context, it's taken from the first 8 bytes
+// of the message
+func (ctx *Context) key(segments [][]byte, ascii bool) BreakerKey {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	key := BreakerKey{DataStore: ctx.ident.dataStore, TranCode: ctx.ident.tranCode}
+	if key.DataStore == "" {
+		key.DataStore = ctx.session.DataStore
+	}
+	if key.TranCode == "" {
+		key.TranCode = tranCodeOf(segments, ascii, ctx.ident.cp())
+	}
+	return key
+}
+
+// tranCodeOf returns the transaction code from the first 8 bytes of the message
+func tranCodeOf(segments [][]byte, ascii bool, cp CodePage) string {
+	if len(segments) == 0 {
+		return ""
+	}
+	tran := segments[0]
+	if len(tran) > 8 {
+		tran = tran[:8]
+	}
+	if !ascii {
+		tran = cp.Decode(tran)
+	}
+	if i := bytes.IndexByte(tran, ' '); i >= 0 {
+		tran = tran[:i]
+	}
+	return string(tran)
+}
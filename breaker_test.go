@@ -0,0 +1,76 @@
+package imstm
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBreakerOutcomes(t *testing.T) {
+	cb := &CircuitBreaker{FailureThreshold: 1, OpenTimeout: time.Millisecond}
+	key := BreakerKey{DataStore: "IMS1", TranCode: "TRAN"}
+
+	for _, err := range []error{ErrContextBusy, fmt.Errorf("send: %w", ErrQueueTimeout), ErrInvalidSegment} {
+		done, aerr := cb.allow(key)
+		if aerr != nil {
+			t.Fatal(aerr)
+		}
+		done(err)
+		if st := cb.State(key); st != BreakerClosed {
+			t.Fatalf("%v opened the circuit", err)
+		}
+	}
+
+	done, _ := cb.allow(key)
+	done(fmt.Errorf("recv: %w", &IMSConnectError{ReturnCode: 16, ReasonCode: 0x1A}))
+	if st := cb.State(key); st != BreakerOpen {
+		t.Fatalf("state is %v after the stopped transaction, want Open", st)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	//a probe failing without reaching IMS gives up its slot and leaves the circuit half-open
+	probe, err := cb.allow(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cb.allow(key); err != ErrCircuitOpen {
+		t.Fatalf("got %v for the second probe, want ErrCircuitOpen", err)
+	}
+	probe(ErrContextBusy)
+	if st := cb.State(key); st != BreakerHalfOpen {
+		t.Fatalf("state is %v, want HalfOpen", st)
+	}
+	probe, err = cb.allow(key)
+	if err != nil {
+		t.Fatalf("probe slot is not released: %v", err)
+	}
+	probe(io.EOF)
+	if st := cb.State(key); st != BreakerOpen {
+		t.Fatalf("state is %v after the failed probe, want Open", st)
+	}
+}
+
+func TestBreakerProbeReleased(t *testing.T) {
+	srv := newFakeServer(t, func(req []byte) []byte { return nil })
+	defer srv.Close()
+	cb := &CircuitBreaker{FailureThreshold: 1, OpenTimeout: time.Millisecond}
+	key := BreakerKey{TranCode: "TRAN"}
+	done, _ := cb.allow(key)
+	done(io.EOF)
+	time.Sleep(2 * time.Millisecond)
+
+	//the probe's response is never read, as its session ends
+	sess := srv.session(t)
+	ctx := NewContext(sess).SetTranCode("TRAN").SetCircuitBreaker(cb)
+	if err := ctx.WithSendRecv(false, false, false).Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cb.allow(key); err != ErrCircuitOpen {
+		t.Fatalf("got %v while the probe is in flight, want ErrCircuitOpen", err)
+	}
+	sess.End()
+	if _, err := cb.allow(key); err != nil {
+		t.Fatalf("probe slot is not released: %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+package imstm
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoEndpoint indicates that there's no healthy endpoint available in the cluster
+var ErrNoEndpoint = errors.New("No healthy endpoint available")
+
+// Endpoint represents an IMS connect instance along with the datastore behind it
+type Endpoint struct {
+	// Addr is the IMS connect server address in the tcp address string format
+	Addr string
+
+	// DataStore is the IMS datastore name to be routed through this endpoint
+	DataStore string
+
+	// Priority is used by the Failover policy, lower values are preferred
+	Priority int
+}
+
+// BalancePolicy represents the policy to pick an endpoint for a new session
+type BalancePolicy int
+
+// List of balance policies
+const (
+	RoundRobin       BalancePolicy = iota //rotate over the healthy endpoints
+	LeastOutstanding                      //pick the endpoint with least in-flight exchanges
+	Failover                              //pick the healthy endpoint with the least priority value
+)
+
+// EndpointStatus represents the health and utilisation of an endpoint
+type EndpointStatus struct {
+	Endpoint
+	Healthy      bool      //endpoint is eligible for new sessions
+	EjectedUntil time.Time //end of the cool-down, if the endpoint is ejected
+	LastErr      error     //error that caused the ejection
+	Sessions     int       //open sessions to the endpoint
+	Outstanding  int       //in-flight exchanges on the endpoint
+}
+
+// endpoint is the cluster's bookkeeping for an Endpoint
+type endpoint struct {
+	Endpoint
+	cluster      *Cluster
+	sessions     int32 //open sessions, accessed atomically
+	outstanding  int32 //in-flight exchanges, accessed atomically
+	ejectedUntil time.Time
+	lastErr      error
+	pingEjected  bool //ejected by a failed ping, recovered by a successful one
+}
+
+// Cluster distributes sessions over multiple IMS connect instances and datastores.
+// Endpoints are ejected on connection failures, failed pings and the datastore unavailable
+// errors - return code 44 or reason codes 72 and 74 with any return code but 16, and are
+// eligible again after the cool-down.
+// Only the endpoints ejected by a failed ping are recovered early by a successful one, as the
+// ping doesn't reach the datastore.
+//
+// A Cluster must not be copied after first use.
+type Cluster struct {
+	// Endpoints are the IMS connect instances and datastores of the cluster
+	Endpoints []Endpoint
+
+	// Policy is the balance policy to pick an endpoint for a new session
+	Policy BalancePolicy
+
+	// CoolDown is the duration for which an unhealthy endpoint is ejected. Defaults to 30s
+	CoolDown time.Duration
+
+	// HealthInterval is the interval of the background pings, once the cluster is started.
+	// Zero disables the background health checks
+	HealthInterval time.Duration
+
+	// ReadTimeout, WriteTimeout and TLSConfig are applied to every session of the cluster
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	TLSConfig    *tls.Config
+
+	// Configure, if set, is invoked to configure every new session before it's started,
+	// e.g. to set the QueueTimeout or the Reconnect policy
+	Configure func(s *Session)
+
+	mu   sync.Mutex
+	eps  []*endpoint
+	next int           //round robin position
+	stop chan struct{} //stops the background health checks
+}
+
+// init initializes the endpoint bookkeeping, once
+func (c *Cluster) init() {
+	if c.eps != nil {
+		return
+	}
+	for _, ep := range c.Endpoints {
+		c.eps = append(c.eps, &endpoint{Endpoint: ep, cluster: c})
+	}
+}
+
+// Start starts the background health checks, if HealthInterval is set
+func (c *Cluster) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	if len(c.eps) == 0 {
+		return ErrNoEndpoint
+	}
+	if c.HealthInterval > 0 && c.stop == nil {
+		c.stop = make(chan struct{})
+		go c.healthLoop(c.stop)
+	}
+	return nil
+}
+
+// End stops the background health checks. Sessions already dialed are not closed.
+func (c *Cluster) End() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+// Dial picks an endpoint as per the balance policy and starts a new session to it.
+// Endpoints failing to connect are ejected and the next one is tried. When none is left,
+// *DialError with the error of the last endpoint tried is returned.
+func (c *Cluster) Dial() (*Session, error) {
+	var last *DialError
+	for {
+		ep, err := c.pick()
+		if err != nil && last != nil {
+			return nil, last
+		}
+		if err != nil {
+			return nil, err
+		}
+		s := &Session{
+			Addr:         ep.Addr,
+			DataStore:    ep.DataStore,
+			ReadTimeout:  c.ReadTimeout,
+			WriteTimeout: c.WriteTimeout,
+			TLSConfig:    c.TLSConfig,
+		}
+		if c.Configure != nil {
+			c.Configure(s)
+		}
+		s.ep = ep
+		if err := s.Start(); err != nil {
+			c.eject(ep, err)
+			last = &DialError{Addr: ep.Addr, Err: err}
+			continue
+		}
+		atomic.AddInt32(&ep.sessions, 1)
+		return s, nil
+	}
+}
+
+// Status returns the health and utilisation of the endpoints
+func (c *Cluster) Status() []EndpointStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	now := time.Now()
+	var out []EndpointStatus
+	for _, ep := range c.eps {
+		st := EndpointStatus{
+			Endpoint:    ep.Endpoint,
+			Healthy:     !now.Before(ep.ejectedUntil),
+			Sessions:    int(atomic.LoadInt32(&ep.sessions)),
+			Outstanding: int(atomic.LoadInt32(&ep.outstanding)),
+		}
+		if !st.Healthy {
+			st.EjectedUntil = ep.ejectedUntil
+			st.LastErr = ep.lastErr
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// Check pings all the endpoints once, ejecting the failed ones. The successful ones are
+// recovered before their cool-down ends, if they were ejected by a failed ping.
+func (c *Cluster) Check() {
+	c.mu.Lock()
+	c.init()
+	eps := append([]*endpoint(nil), c.eps...)
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ep := range eps {
+		wg.Add(1)
+		go func(ep *endpoint) {
+			defer wg.Done()
+			if err := c.ping(ep); err != nil {
+				c.ejectPing(ep, err)
+				return
+			}
+			c.recover(ep)
+		}(ep)
+	}
+	wg.Wait()
+}
+
+// ping checks the endpoint using a short lived session
+func (c *Cluster) ping(ep *endpoint) error {
+	s := &Session{
+		Addr:         ep.Addr,
+		DataStore:    ep.DataStore,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		TLSConfig:    c.TLSConfig,
+	}
+	if err := s.Start(); err != nil {
+		return err
+	}
+	defer s.End()
+	return s.Ping()
+}
+
+// healthLoop pings the endpoints every HealthInterval till stopped
+func (c *Cluster) healthLoop(stop chan struct{}) {
+	ticker := time.NewTicker(c.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.Check()
+		}
+	}
+}
+
+// pick selects a healthy endpoint as per the balance policy
+func (c *Cluster) pick() (*endpoint, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	now := time.Now()
+	var healthy []*endpoint
+	for _, ep := range c.eps {
+		if !now.Before(ep.ejectedUntil) {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	best := healthy[0]
+	switch c.Policy {
+	case LeastOutstanding:
+		for _, ep := range healthy[1:] {
+			if atomic.LoadInt32(&ep.outstanding) < atomic.LoadInt32(&best.outstanding) {
+				best = ep
+			}
+		}
+	case Failover:
+		for _, ep := range healthy[1:] {
+			if ep.Priority < best.Priority {
+				best = ep
+			}
+		}
+	default:
+		best = healthy[c.next%len(healthy)]
+		c.next++
+	}
+	return best, nil
+}
+
+// eject marks the endpoint unhealthy for the cool-down duration
+func (c *Cluster) eject(ep *endpoint, err error) {
+	c.ejectFor(ep, err, false)
+}
+
+// ejectPing marks the endpoint unhealthy after a failed ping
+func (c *Cluster) ejectPing(ep *endpoint, err error) {
+	c.ejectFor(ep, err, true)
+}
+
+// ejectFor marks the endpoint unhealthy, recording whether a failed ping ejected it
+func (c *Cluster) ejectFor(ep *endpoint, err error, byPing bool) {
+	coolDown := c.CoolDown
+	if coolDown <= 0 {
+		coolDown = 30 * time.Second
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ep.ejectedUntil = time.Now().Add(coolDown)
+	ep.lastErr = err
+	ep.pingEjected = byPing
+}
+
+// recover marks the endpoint healthy, unless it's ejected for a reason other than a failed
+// ping, which waits out the cool-down
+func (c *Cluster) recover(ep *endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ep.pingEjected {
+		return
+	}
+	ep.ejectedUntil = time.Time{}
+	ep.lastErr = nil
+	ep.pingEjected = false
+}
+
+// DialError is returned by Dial, when every endpoint tried failed to connect. It matches
+// ErrNoEndpoint with errors.Is
+type DialError struct {
+	Addr string //address of the last endpoint tried
+	Err  error  //error connecting to the endpoint
+}
+
+// Error returns the description of the last failure
+func (e *DialError) Error() string {
+	return ErrNoEndpoint.Error() + ": dial " + e.Addr + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error connecting to the last endpoint tried
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrNoEndpoint
+func (e *DialError) Is(target error) bool {
+	return target == ErrNoEndpoint
+}
+
+// unhealthy reports whether the error implies that the endpoint or its datastore is unavailable
+func unhealthy(err error) bool {
+	if e, ok := err.(*IMSConnectError); ok {
+		return e.ReturnCode == 44 || (e.ReturnCode != 16 && (e.ReasonCode == 72 || e.ReasonCode == 74))
+	}
+	return false
+}
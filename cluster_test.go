@@ -0,0 +1,78 @@
+package imstm
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// pong replies to the ping requests
+func pong(req []byte) []byte {
+	return frame(seg(A2E([]byte("PING RESPONSE"))), csmSeg(0, 0))
+}
+
+func TestClusterDialError(t *testing.T) {
+	var eps []Endpoint
+	for i := 0; i < 2; i++ {
+		srv := newFakeServer(t, pong)
+		eps = append(eps, Endpoint{Addr: srv.l.Addr().String()})
+		srv.Close()
+	}
+	c := &Cluster{Endpoints: eps}
+	_, err := c.Dial()
+	if !errors.Is(err, ErrNoEndpoint) {
+		t.Fatalf("got %v, want ErrNoEndpoint", err)
+	}
+	var derr *DialError
+	if !errors.As(err, &derr) || derr.Addr != eps[1].Addr {
+		t.Fatalf("got %v, want *DialError of %s", err, eps[1].Addr)
+	}
+	var nerr net.Error
+	if !errors.As(err, &nerr) {
+		t.Fatalf("%v doesn't wrap the dial error", err)
+	}
+	if _, err := c.Dial(); err != ErrNoEndpoint {
+		t.Fatalf("got %v, want ErrNoEndpoint", err)
+	}
+}
+
+func TestClusterRecover(t *testing.T) {
+	srv := newFakeServer(t, pong)
+	defer srv.Close()
+	c := &Cluster{Endpoints: []Endpoint{{Addr: srv.l.Addr().String()}}}
+	c.init()
+	ep := c.eps[0]
+
+	//a successful ping recovers the endpoint ejected by a failed ping
+	c.ejectPing(ep, ErrNoPingResponse)
+	c.Check()
+	if st := c.Status()[0]; !st.Healthy {
+		t.Fatalf("ping ejected endpoint is not recovered: %v", st.LastErr)
+	}
+
+	//the datastore ejections wait out the cool-down
+	c.eject(ep, &IMSConnectError{ReturnCode: 44})
+	c.Check()
+	if st := c.Status()[0]; st.Healthy {
+		t.Fatal("datastore ejected endpoint is recovered by a ping")
+	}
+}
+
+func TestUnhealthy(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&IMSConnectError{ReturnCode: 44}, true},
+		{&IMSConnectError{ReturnCode: 4, ReasonCode: 72}, true},
+		{&IMSConnectError{ReturnCode: 8, ReasonCode: 74}, true},
+		{&IMSConnectError{ReturnCode: 16, ReasonCode: 72}, false},
+		{&IMSConnectError{ReturnCode: 16, ReasonCode: 74}, false},
+		{&IMSConnectError{ReturnCode: 4, ReasonCode: 73}, false},
+		{errors.New("reset"), false},
+	} {
+		if got := unhealthy(tc.err); got != tc.want {
+			t.Errorf("unhealthy(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
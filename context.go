@@ -1,10 +1,23 @@
 package imstm
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"sync"
 	"time"
 )
 
+// ErrNoResponse indicates that there's no response received in the context to acknowledge
+var ErrNoResponse = errors.New("No response to acknowledge")
+
+// ErrResponseIncomplete indicates that the response is not completely read before acknowledging it
+var ErrResponseIncomplete = errors.New("Response is not completely read")
+
+// ErrAckNotExpected indicates that the response doesn't expect an acknowledgement
+// or it is already acknowledged
+var ErrAckNotExpected = errors.New("Acknowledgement not expected")
+
 // Sender sends the IMS connect message
 type Sender interface {
 	Send(segments [][]byte, ascii bool) error
@@ -28,109 +41,346 @@ type SendReceiver interface {
 	Receiver
 }
 
-// Context is a structure that holds the connection and state details of the IMS connect communication Context
+// Context is a structure that holds the connection and state details of the IMS connect communication Context.
+//
+// A Context can be configured from multiple goroutines, but an exchange must be driven by a single
+// goroutine. Use a Context per goroutine to share a Session across goroutines.
 type Context struct {
-	session *Session
-	irm     *IRMHeader
-	active  bool //tells if a context is already active
+	mu        sync.Mutex //guards the fields below, except active
+	session   *Session
+	irm       *IRMHeader
+	active    bool      //tells if a context is already active, guarded by the session
+	proto     protocol  //protocol the context is switched to
+	last      *Response //last response received in this context
+	lastWrite time.Time //time of the last request written in this context
+	ident     identity  //configuration retained across protocol switches
+	breaker   *CircuitBreaker
+	outcome   func(err error) //settles the pending request on the breaker and the limiter
+	chain     []Interceptor   //interceptors of the exchanges
+	gctx      context.Context //context of the caller for the interceptors
+	pending   BreakerKey      //datastore and transaction code of the last request
+	otma      []byte          //client built otma headers of the requests, if any
+	xid       []byte          //X/Open identifier of the requests under a global transaction
+	conv      bool            //requests are the iterations of an IMS conversation
 }
 
-// SetReroute adds the client id to the irm header
-func (ctx *Context) SetReroute(clientID string) *Context {
-	ctx.irm.setReroute(clientID)
+// TODO: for irm timer - setTimeout adds the lterm override to the iopcb
+func (ctx *Context) setTimeout(timeout time.Duration) *Context {
 	return ctx
 }
 
-// SetClientID adds the client id to the irm header
-func (ctx *Context) SetClientID(clientID string) *Context {
-	copy(ctx.irm.ClientID[:], A2E([]byte(clientID))) //8-bytes client id
-	return ctx
+// snapshot returns a copy of the irm header and the protocol of the context
+func (ctx *Context) snapshot() (IRMHeader, protocol) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return *ctx.irm, ctx.proto
 }
 
-// SetTranCode adds the transaction id to the irm header
-func (ctx *Context) SetTranCode(tranCode string) *Context {
-	copy(ctx.irm.TranCode[:], A2E([]byte(tranCode))) //8-bytes transaction code
-	return ctx
-}
+// send sends a message with multiple segments using the supplied irm header and the prefix
+// following it, if any, and returns the length of the request
+func send(ctx *Context, irm *IRMHeader, prefix []byte, segments [][]byte, ascii bool) (int, error) {
+	ctx.mu.Lock()
+	cp := ctx.ident.cp()
+	ctx.mu.Unlock()
 
-// SetLterm adds the lterm override to the iopcb
-func (ctx *Context) SetLterm(lterm string) *Context {
-	copy(ctx.irm.Lterm[:], A2E([]byte(lterm))) //8-bytes ltermoverride
-	return ctx
+	sess := ctx.session
+	request := newRequest(sess.connection(), *irm, sess.WriteTimeout, sess.exit())
+	request.addPrefix(prefix)
+	for _, segment := range segments {
+		if ascii {
+			request.AddSegment(cp.Encode(segment))
+		} else {
+			request.AddSegment(segment)
+		}
+	}
+
+	sess.dumpRequest(request)
+	err := request.Write()
+	ctx.mu.Lock()
+	ctx.lastWrite = time.Now()
+	ctx.mu.Unlock()
+	return int(request.length), err
 }
 
-// SetModName adds the mod name to the iopcb
-func (ctx *Context) SetModName(modName string) *Context {
-	copy(ctx.irm.ModName[:], A2E([]byte(modName))) //8-bytes mod name
-	return ctx
+// request writes a new request in the context and moves the session to the next state
+func request(ctx *Context, segments [][]byte, ascii bool, expectResponse bool) error {
+	irm, proto := ctx.snapshot()
+	call := &Call{Op: OpSend, IRM: &irm, Segments: segments, ASCII: ascii, expect: expectResponse}
+	if proto == protoRecvOnly {
+		call.Op = OpResume
+	}
+	ctx.mu.Lock()
+	call.OTMA, call.XID = ctx.otma, ctx.xid
+	ctx.mu.Unlock()
+	return ctx.exchange(call, write)
 }
 
-// SetCredentials adds the racf credentials
-func (ctx *Context) SetCredentials(userid string, grpid string, passwd string) *Context {
-	copy(ctx.irm.Userid[:], A2E([]byte(userid)))
-	copy(ctx.irm.Grpid[:], A2E([]byte(grpid)))
-	copy(ctx.irm.Passwd[:], A2E([]byte(passwd)))
-	return ctx
+// write is the innermost exchange of the requests
+func write(call *Call) error {
+	ctx := call.Context
+	sess := ctx.session
+	_, proto := ctx.snapshot()
+	done, err := ctx.guard(proto, call.Segments, call.ASCII)
+	if err != nil {
+		return err
+	}
+	if err := sess.connected(call.GoContext); err != nil {
+		done(err)
+		return err
+	}
+	if err := sess.begin(ctx, proto); err != nil {
+		done(err)
+		return err
+	}
+	n, err := send(ctx, call.IRM, append(append([]byte(nil), call.XID...), call.OTMA...), call.Segments, call.ASCII)
+	call.Written = n
+	if err != nil {
+		sess.fail(ctx, err)
+		done(err)
+		sess.emit(Event{Type: EventSend, Op: call.Op, Err: err})
+		return err
+	}
+	key := ctx.key(call.Segments, call.ASCII)
+	ctx.mu.Lock()
+	ctx.pending = key
+	ctx.mu.Unlock()
+	sess.emit(Event{
+		Type:      EventSend,
+		Op:        call.Op,
+		DataStore: key.DataStore,
+		TranCode:  key.TranCode,
+		Bytes:     n,
+		Segments:  len(call.Segments),
+	})
+	if call.expect {
+		ctx.await(done)
+	} else {
+		done(nil)
+	}
+	sess.sent(ctx, proto, call.expect)
+	return nil
 }
 
-// TODO: for irm timer - setTimeout adds the lterm override to the iopcb
-func (ctx *Context) setTimeout(timeout time.Duration) *Context {
-	return ctx
+// recv receives a response message
+func recv(ctx *Context) (*Response, error) {
+	call := &Call{Op: OpRecv}
+	err := ctx.exchange(call, read)
+	return call.Response, err
 }
 
-// send sends a message with multiple segments
-func send(ctx *Context, segments [][]byte, ascii bool) error {
-	request := NewRequest(ctx.session.conn, *ctx.irm, ctx.session.WriteTimeout)
-	for _, segment := range segments {
-		if ascii {
-			request.AddSegment(A2E(segment))
-		}
+// read is the innermost exchange of the responses
+func read(call *Call) error {
+	ctx := call.Context
+	sess := ctx.session
+	if err := sess.receiving(ctx); err != nil {
+		return err
+	}
+	irm, _ := ctx.snapshot()
+	resp := sess.newResponse()
+	resp.cm0 = irm.F2&IRMF2CM0 != 0
+	resp.async = irm.F4 == IRMF4RESTPIPE
+	resp.flow = resp.async && irm.F5&(IRMF5SNGLWT|IRMF5SNGLNWT) == 0
+	//resume tpipe output is always acknowledged, send-recv output only with sync level CONFIRM
+	resp.ackExpected = resp.async || irm.F3&IRMF3SYNCNF != 0
+	resp.syncpt = irm.F3&IRMF3SYNCPT != 0
+	resp.dfs2082 = irm.F3&IRMF3DFS2082 != 0
+	resp.onDone = func(r *Response, err error) {
+		sess.received(ctx, r, err)
+		ctx.settle(r, err)
+		ctx.observe(r, err)
 	}
 
-	return request.Write()
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if !ctx.lastWrite.IsZero() {
+		resp.start = ctx.lastWrite
+	}
+	resp.conv = ctx.conv
+	resp.codePage = ctx.ident.codePage
+	resp.dump = sess.dumpSegment
+	ctx.last = resp
+	call.Response = resp
+	return nil
 }
 
-// recv receives a response message
-func recv(ctx *Context) *Response {
-	return NewResponse(ctx.session.conn, ctx.session.ReadTimeout)
+// checkAck verifies that the last response in the context expects an acknowledgement
+func checkAck(ctx *Context) error {
+	ctx.mu.Lock()
+	resp := ctx.last
+	ctx.mu.Unlock()
+	if resp == nil {
+		return ErrNoResponse
+	}
+	if !resp.done {
+		return ErrResponseIncomplete
+	}
+	if st := resp.Status(); !st.AckRequired || st.Acknowledged {
+		return ErrAckNotExpected
+	}
+	return ctx.session.acking(ctx)
 }
 
 // ack acknowledges positively
 func ack(ctx *Context) error {
-	oldF4 := ctx.irm.F4
-	defer func() {
-		ctx.irm.F4 = oldF4
-	}()
-	ctx.irm.F4 = IRMF4ACK
-	return send(ctx, nil, false)
+	irm, _ := ctx.snapshot()
+	irm.F4 = IRMF4ACK
+	return ctx.exchange(&Call{Op: OpAck, IRM: &irm}, acknowledge)
 }
 
 // nak acknowledges negatively
 func nak(ctx *Context, reason uint16, retainMsg bool) error {
-	oldF0 := ctx.irm.F0
-	oldNakRsn := ctx.irm.NakRsn
-	oldF4 := ctx.irm.F4
-	defer func() {
-		ctx.irm.F0 = oldF0
-		ctx.irm.NakRsn = oldNakRsn //check the beauty of go arrays which perform value copy
-		ctx.irm.F4 = oldF4
-	}()
-	ctx.irm.F4 = IRMF4NACK //negative ack
+	irm, _ := ctx.snapshot()
+	irm.F4 = IRMF4NACK //negative ack
 	if retainMsg {
-		ctx.irm.F0 = IRMF0SYNCNAK //keep the message on tpipe queue
+		irm.F0 = IRMF0SYNCNAK //keep the message on tpipe queue
 	}
 	if reason != 0 {
-		ctx.irm.F0 = ctx.irm.F0 | IRMF0NAKRSN
-		binary.BigEndian.PutUint16(ctx.irm.NakRsn[:], reason)
+		irm.F0 = irm.F0 | IRMF0NAKRSN
+		binary.BigEndian.PutUint16(irm.NakRsn[:], reason)
+	}
+	return ctx.exchange(&Call{Op: OpNak, IRM: &irm}, acknowledge)
+}
+
+// acknowledge is the innermost exchange of the acknowledgements. It writes the ack or nak
+// irm header and moves the session state
+func acknowledge(call *Call) error {
+	ctx := call.Context
+	if err := checkAck(ctx); err != nil {
+		return err
+	}
+	sess := ctx.session
+	ctx.mu.Lock()
+	resp, key := ctx.last, ctx.pending
+	ctx.mu.Unlock()
+	resp.acked = true
+	ev := Event{Type: EventAck, Op: call.Op, DataStore: key.DataStore, TranCode: key.TranCode}
+	if call.Op == OpNak {
+		ev.Type = EventNak
+	}
+	n, err := send(ctx, call.IRM, nil, nil, false)
+	ev.Bytes, call.Written = n, n
+	if err != nil {
+		sess.fail(ctx, err)
+		ev.Err = err
+		sess.emit(ev)
+		return err
+	}
+	//IMS connect replies to the acknowledgement of the CM0 output, unless NOWAIT is set
+	if resp.cm0 && !resp.async && call.IRM.F1&IRMF1NOWAIT == 0 {
+		if err := awaitAck(ctx); err != nil {
+			sess.release(ctx)
+			ev.Err = err
+			sess.emit(ev)
+			return err
+		}
+	}
+	sess.acked(ctx, resp)
+	sess.emit(ev)
+	return nil
+}
+
+// awaitAck reads the reply of IMS connect to the acknowledgement of the CM0 output, which is
+// its status, or the error of the acknowledgement
+func awaitAck(ctx *Context) error {
+	sess := ctx.session
+	resp := sess.newResponse()
+	resp.dump = sess.dumpSegment
+	err := resp.readAllSegments()
+	if cause := lostConn(resp, err); cause != nil {
+		sess.disconnect(cause)
+	}
+	if err != nil {
+		return err
 	}
-	return send(ctx, nil, false)
+	return resp.statusErr()
 }
 
-// end - ends the Context but doesn't close the underlying connection
-func (ctx *Context) end() error {
+// observe emits the event of the completed response
+func (ctx *Context) observe(r *Response, err error) {
+	ctx.mu.Lock()
+	key := ctx.pending
+	ctx.mu.Unlock()
+	if err == nil {
+		err = r.statusErr()
+	}
+	st := r.Status()
+	ctx.session.emit(Event{
+		Type:      EventResponse,
+		Op:        OpRecv,
+		DataStore: key.DataStore,
+		TranCode:  key.TranCode,
+		Bytes:     st.TotalBytes,
+		Segments:  st.Segments,
+		Duration:  time.Since(r.start),
+		Wait:      st.TimeToFirstByte,
+		Async:     r.async,
+		Err:       err,
+	})
+}
+
+// deallocate ends the active IMS conversation
+func deallocate(ctx *Context) error {
+	sess := ctx.session
+	defer sess.release(ctx)
+	irm, _ := ctx.snapshot()
+	irm.F4 = IRMF4DEALLOC
+	if _, err := send(ctx, &irm, nil, nil, false); err != nil {
+		sess.disconnect(err)
+		return err
+	}
+	resp := sess.newResponse()
+	err := resp.readAllSegments()
+	if cause := lostConn(resp, err); cause != nil {
+		sess.disconnect(cause)
+	}
+	if err != nil {
+		return err
+	}
+	if resp.rsm != nil && resp.rsnCode != 97 { //97 - deallocate confirmed
+		return resp.statusErr()
+	}
+	return nil
+}
+
+// State returns the protocol state of the session, as driven by this context.
+func (ctx *Context) State() SessionState {
+	return ctx.session.State()
+}
+
+// End ends the Context but doesn't close the underlying connection. It releases the session,
+// so that another context can be switched to. An active IMS conversation is deallocated.
+//
+// It returns ErrResponseIncomplete or ErrAckPending, if the current exchange is not yet complete.
+func (ctx *Context) End() error {
+	sess := ctx.session
+	state, err := sess.owned(ctx)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case StateAwaitingResponse:
+		return ErrResponseIncomplete
+	case StateAwaitingAck:
+		return ErrAckPending
+	case StateInConversation:
+		return deallocate(ctx)
+	}
+	sess.release(ctx)
+	ctx.abandon(ErrResponseIncomplete)
 	return nil
 }
 
+// switchTo installs the irm header for the protocol the context is switched to
+func (ctx *Context) switchTo(proto protocol, irm *IRMHeader) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.proto = proto
+	ctx.irm = irm
+	ctx.otma = nil
+	ctx.xid = nil
+	ctx.conv = false
+}
+
 // NewContext creates and returns a new context
 func NewContext(session *Session) *Context {
 	ctx := &Context{}
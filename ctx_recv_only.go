@@ -2,33 +2,39 @@ package imstm
 
 // ctxRecvOnly is the context structure for recv only or resume-tpipe protocol
 type ctxRecvOnly struct {
-	ctx     *Context
-	initial bool //identifies if the current context is in initial state
+	ctx *Context
+	err error //error switching the context
 	Receiver
 }
 
-// Recv fetches the messages from async hold queue
+// Recv fetches the messages from async hold queue.
+// The resume tpipe request is issued whenever the session is not already in resume tpipe,
+// i.e. on the first call and after the single message or an error terminates it.
 func (r *ctxRecvOnly) Recv() (*Response, error) {
-	defer func() {
-
-	}()
-	if !r.initial {
-		if err := send(r.ctx, nil, false); err != nil {
+	if err := r.ctx.using(protoRecvOnly, r.err); err != nil {
+		return nil, err
+	}
+	if state, err := r.ctx.session.owned(r.ctx); err == ErrContextBusy || state == StateIdle {
+		if err := request(r.ctx, nil, false, true); err != nil {
 			return nil, err
 		}
-		r.initial = true
 	}
-	resp := recv(r.ctx)
-	return resp, nil
+	return recv(r.ctx)
 }
 
 // Ack acknowleges the response positively
 func (r *ctxRecvOnly) Ack() error {
+	if err := r.ctx.using(protoRecvOnly, r.err); err != nil {
+		return err
+	}
 	return ack(r.ctx)
 }
 
 // Nak acknowleges the response negatively
 func (r *ctxRecvOnly) Nak(reason uint16, retainMsg bool) error {
+	if err := r.ctx.using(protoRecvOnly, r.err); err != nil {
+		return err
+	}
 	return nak(r.ctx, reason, retainMsg)
 }
 
@@ -43,16 +49,20 @@ func (r *ctxRecvOnly) Nak(reason uint16, retainMsg bool) error {
 // are exhausted on the queue.
 //
 // Acknowledgement of messages, using Ack() or Nak(..) are necessary after the receipt of messages.
+// flow is ignored when singleMsg is set; RecvOnly rejects such combinations instead.
+//
+// If the context is in the middle of an exchange, the context is not switched and the
+// returned Receiver fails with ErrContextBusy.
 func (ctx *Context) WithRecvOnly(singleMsg bool, flow bool, wait bool) Receiver {
 	sctx := &ctxRecvOnly{}
 	sctx.ctx = ctx
+	if err := ctx.session.switchable(ctx); err != nil {
+		sctx.err = err
+		return sctx
+	}
 
-	//initialize irm
-	ctx.irm = (&IRMHeader{}).init()
-	//add data store
-	copy(ctx.irm.DestID[:], A2E([]byte(ctx.session.DataStore))) //8-bytes datastore
-
-	irm := ctx.irm
+	//initialize irm, retaining the identity of the context
+	irm := ctx.newIRM()
 
 	//for recv only
 	irm.F2 = IRMF2CM0
@@ -70,5 +80,6 @@ func (ctx *Context) WithRecvOnly(singleMsg bool, flow bool, wait bool) Receiver
 		irm.F5 = irm.F5 | IRMF5NAUTFLOW
 	}
 
+	ctx.switchTo(protoRecvOnly, irm)
 	return sctx
 }
@@ -3,30 +3,27 @@ package imstm
 // ctxSendOnly is the context structure for send only protocol
 type ctxSendOnly struct {
 	ctx         *Context
-	ackRequired bool //acknowledgement required?
+	ackRequired bool  //acknowledgement required?
+	err         error //error switching the context
 	Sender
 }
 
 // Send sends the message using sendonly protocol
 func (s *ctxSendOnly) Send(segments [][]byte, ascii bool) error {
-	if err := send(s.ctx, segments, ascii); err != nil {
+	if err := s.ctx.using(protoSendOnly, s.err); err != nil {
 		return err
 	}
-	//if check ack is set, auto acknowledge
+	if err := request(s.ctx, segments, ascii, s.ackRequired); err != nil {
+		return err
+	}
+	//if check ack is set, wait for the acknowledgement from IMS connect
 	if s.ackRequired {
-		//TODO: remove-debug
-		/*resp := recv(s.ctx)
-		for {
-			if typ, data, err := resp.ReadNextSegment(); err != nil {
-				return err
-			} else {
-				fmt.Printf("type is %X\n", typ)
-				fmt.Printf("%X\n", data)
-				if typ == RESPSEGCSM || typ == RESPSEGERR || typ == RESPSEGINV {
-					break
-				}
-			}
-		}*/
+		resp, err := recv(s.ctx)
+		if err != nil {
+			return err
+		}
+		_, err = resp.Out(false)
+		return err
 	}
 	return nil
 }
@@ -38,16 +35,19 @@ func (s *ctxSendOnly) Send(segments [][]byte, ascii bool) error {
 // serialDelivery indicates the ordered scheduling of messages, when the IMS transaction
 // schedule type is defined as serial. This option will not have any effect on the parallel
 // schedule type transactions
+//
+// If the context is in the middle of an exchange, the context is not switched and the
+// returned Sender fails with ErrContextBusy.
 func (ctx *Context) WithSendOnly(ackRequired bool, serialDelivery bool) Sender {
 	sctx := &ctxSendOnly{}
 	sctx.ctx = ctx
+	if err := ctx.session.switchable(ctx); err != nil {
+		sctx.err = err
+		return sctx
+	}
 
-	//initialize irm
-	ctx.irm = (&IRMHeader{}).init()
-	//add data store
-	copy(ctx.irm.DestID[:], A2E([]byte(ctx.session.DataStore))) //8-bytes datastore
-
-	irm := ctx.irm
+	//initialize irm, retaining the identity of the context
+	irm := ctx.newIRM()
 	//send only has to be CM0
 	irm.F2 = IRMF2CM0
 
@@ -58,9 +58,10 @@ func (ctx *Context) WithSendOnly(ackRequired bool, serialDelivery bool) Sender {
 
 	irm.F4 = IRMF4SENDONLY
 	if ackRequired {
-		irm.F4 = irm.F4 | IRMF4SNDONLYA //VERIFY: If IRMF4SNDONLY or IRMF4SYNRESPA
+		irm.F4 = IRMF4SNDONLYA
 		sctx.ackRequired = true
 	}
 
+	ctx.switchTo(protoSendOnly, irm)
 	return sctx
 }
@@ -1,33 +1,93 @@
 package imstm
 
+import "strconv"
+
 // ctxSendRecv is the context structure for send only protocol
 type ctxSendRecv struct {
 	ctx    *Context
-	ackReq bool //acknowledgement required?
+	ackReq bool  //acknowledgement required?
+	err    error //error switching the context
 }
 
 // Send sends the ims message with all the message segments
 func (s *ctxSendRecv) Send(segments [][]byte, ascii bool) error {
-	err := send(s.ctx, segments, ascii)
-	return err
+	if err := s.ctx.using(protoSendRecv, s.err); err != nil {
+		return err
+	}
+	return request(s.ctx, segments, ascii, true)
 }
 
 // Recv fetches the response back
 func (s *ctxSendRecv) Recv() (*Response, error) {
-	resp := recv(s.ctx)
-	return resp, nil
+	if err := s.ctx.using(protoSendRecv, s.err); err != nil {
+		return nil, err
+	}
+	return recv(s.ctx)
 }
 
 // Ack acknowleges the response positively
 func (s *ctxSendRecv) Ack() error {
+	if err := s.ctx.using(protoSendRecv, s.err); err != nil {
+		return err
+	}
 	return ack(s.ctx)
 }
 
 // Nak acknowleges the response negatively
 func (s *ctxSendRecv) Nak(reason uint16, retainMsg bool) error {
+	if err := s.ctx.using(protoSendRecv, s.err); err != nil {
+		return err
+	}
 	return nak(s.ctx, reason, retainMsg)
 }
 
+// SyncLevel is the sync level of the send-receive output, telling how it's confirmed
+type SyncLevel byte
+
+// Sync levels of the send-receive output
+const (
+	SyncNone    SyncLevel = iota //output is not confirmed
+	SyncConfirm                  //output is confirmed with Ack() or Nak(..)
+	SyncPoint                    //output is committed with the global transaction, see Tx
+)
+
+// syncLevelNames are the names of the sync levels
+var syncLevelNames = map[SyncLevel]string{
+	SyncNone:    "NONE",
+	SyncConfirm: "CONFIRM",
+	SyncPoint:   "SYNCPT",
+}
+
+// String returns the name of the sync level
+func (l SyncLevel) String() string {
+	if str, ok := syncLevelNames[l]; ok {
+		return str
+	}
+	return "Unknown: " + strconv.Itoa(int(l))
+}
+
+// validate checks the sync level of a send-receive outside a global transaction
+func (l SyncLevel) validate() error {
+	switch l {
+	case SyncNone, SyncConfirm:
+		return nil
+	case SyncPoint:
+		return &IRMError{"sync level", "SYNCPT is valid only under a global transaction, with Tx.SendRecv"}
+	}
+	return &IRMError{"sync level", l.String()}
+}
+
+// flag returns the IRMF3 flag of the sync level
+func (l SyncLevel) flag() byte {
+	switch l {
+	case SyncConfirm:
+		return IRMF3SYNCNF
+	case SyncPoint:
+		return IRMF3SYNCPT
+	}
+	return 0
+}
+
 // WithSendRecv switches the current context into send-recv mode.
 //
 // checkAck, for CM1 (send-then-commit) indicates IMS to hold off the sync point commits,
@@ -38,31 +98,50 @@ func (s *ctxSendRecv) Nak(reason uint16, retainMsg bool) error {
 //
 // purgeUndelivered, for CM0 and CM1 indicates to purge the undelivered CM0
 // output messages from the tpipe message queue.
+//
+// If the context is in the middle of an exchange, the context is not switched and the
+// returned SendReceiver fails with ErrContextBusy.
 func (ctx *Context) WithSendRecv(checkAck bool, withTpipe bool, purgeUndelivered bool) SendReceiver {
-	sendrecv := &ctxSendRecv{}
-
-	//initialize irm
-	ctx.irm = (&IRMHeader{}).init()
-	//add data store
-	copy(ctx.irm.DestID[:], A2E([]byte(ctx.session.DataStore))) //8-bytes datastore
+	level := SyncNone
+	if checkAck || withTpipe {
+		level = SyncConfirm
+	}
+	return ctx.WithSyncLevel(level, withTpipe, purgeUndelivered)
+}
 
+// WithSyncLevel switches the current context into send-recv mode with the sync level of the
+// output, SyncNone or SyncConfirm. withTpipe indicates the CM0 communication mode. SyncPoint,
+// valid only under a global transaction with Tx.SendRecv, fails the returned SendReceiver
+// with *IRMError. Response.Confirmation() tells the action required for the output.
+//
+// If the context is in the middle of an exchange, the context is not switched and the
+// returned SendReceiver fails with ErrContextBusy.
+func (ctx *Context) WithSyncLevel(level SyncLevel, withTpipe bool, purgeUndelivered bool) SendReceiver {
+	sendrecv := &ctxSendRecv{}
 	sendrecv.ctx = ctx
+	if err := ctx.session.switchable(ctx); err != nil {
+		sendrecv.err = err
+		return sendrecv
+	}
+	if err := level.validate(); err != nil {
+		sendrecv.err = err
+		return sendrecv
+	}
 
-	irm := ctx.irm
+	//initialize irm, retaining the identity of the context
+	irm := ctx.newIRM()
 	//user portion of the irm header
 	irm.F1 = IRMF1CIDREQ | IRMF1MFSREQ //get client-id, modname by default
 	irm.F2 = IRMF2CM1                  //if no tpipe, use CM1
 
 	//applies to CM0
 	if withTpipe {
-		irm.F2 = IRMF2CM0                          //commit then send
-		irm.F3 = irm.F3 | IRMF3IPURG | IRMF3SYNCNF //VERIFY: cancel the duplicate client-id
+		irm.F2 = IRMF2CM0            //commit then send
+		irm.F3 = irm.F3 | IRMF3IPURG //VERIFY: cancel the duplicate client-id
 	}
 
 	//applies to both CM0 and CM1
-	if checkAck {
-		irm.F3 = irm.F3 | IRMF3SYNCNF
-	}
+	irm.F3 = irm.F3 | level.flag()
 
 	//applies to both CM0 and CM1
 	if purgeUndelivered {
@@ -71,5 +150,6 @@ func (ctx *Context) WithSendRecv(checkAck bool, withTpipe bool, purgeUndelivered
 
 	irm.F4 = IRMF4SENDRECV //send-recv protocol
 
+	ctx.switchTo(protoSendRecv, irm)
 	return sendrecv
 }
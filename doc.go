@@ -1,6 +1,6 @@
 /*
 Package imstm provides IMS connect tcp/ip client implementation.
-This library uses HWSSMPL1 as the standard messaging exit.
+This library uses HWSSMPL1 as the default messaging exit.
 
 The low level primitives include Request, Response, IRMHeader and
 the higher level constructs include Session, Context, Sender, Receiver etc.
@@ -38,10 +38,162 @@ One would create a blank context sets its configuration as follows:
 	ctx.SetClientID("CLIENT01").SetReroute("CLNDLQ01")
 
 Context parameters can be set during any time of the communication and the
-configuration immediately takes effect. However Only a single context can be
+configuration immediately takes effect. The configuration is retained when the
+context is switched to a different protocol, only the protocol flags are reset. However Only a single context can be
 active at a time for a given session.
 
+The session tracks the protocol state of the current exchange - Idle, AwaitingResponse,
+AwaitingAck, InConversation and InResumeTpipe - which can be queried using sess.State().
+Operations that are illegal in the current state fail with ErrContextBusy, ErrAckPending,
+ErrResponseIncomplete or ErrInvalidState, instead of corrupting the message stream.
+ctx.End() releases the session for other contexts, deallocating any active conversation.
+A conversation is declared with the Conversational option of SendRecv.
+
+A Session is safe for concurrent use, when each goroutine uses its own Context. Complete
+exchanges are serialized on the connection; by default a context finding the session busy
+fails with ErrContextBusy. Setting QueueTimeout on the session lets the contexts wait in
+line for the connection instead:
+
+	sess.QueueTimeout = 2 * time.Second
+
+When IMS connect closes the socket, the session can reconnect automatically before the
+next request, by setting a ReconnectPolicy. A request that failed with the lost connection
+is never replayed, while a resume tpipe receiver re-issues the resume tpipe on its next Recv():
+
+	sess.Reconnect = &ims.ReconnectPolicy{MaxAttempts: 5, InitialBackoff: time.Second, Jitter: 0.2}
+	sess.OnDisconnect = func(err error) { log.Println("disconnected:", err) }
+
+IMS connect errors in the RSM segment are returned as *IMSConnectError, which carries the
+return and reason codes.
+
+A RetryPolicy retries the send-receive exchanges on transient errors, like the datastore
+being unavailable. Exchanges that may have reached OTMA are retried only for the contexts
+marked idempotent. The returned *RetryError carries the history of the attempts:
+
+	policy := &ims.RetryPolicy{MaxAttempts: 3, Backoff: 200 * time.Millisecond}
+	sr := policy.Wrap(ctx.SetIdempotent(true).WithSendRecv(false, false, false))
+
+A CircuitBreaker fails the requests with ErrCircuitOpen, before writing them, once a transaction
+or a datastore keeps failing. The circuits are keyed by the datastore and the transaction code,
+and are probed again after the OpenTimeout:
+
+	cb := &ims.CircuitBreaker{FailureThreshold: 5, OpenTimeout: 30 * time.Second}
+	ctx.SetCircuitBreaker(cb)
+	for _, st := range cb.Status() {
+		log.Println(st.Key.TranCode, st.State, st.Failures)
+	}
+
+A Limiter caps the messages per second per transaction code and per datastore, and the exchanges
+in flight. The limited senders wait for the limits till the context.Context set by SetGoContext
+is done, or fail fast with ErrRateLimited:
+
+	limiter := &ims.Limiter{
+		TranCodes:   map[string]ims.Rate{"ORDERTXN": {PerSecond: 50, Burst: 10}},
+		MaxInFlight: 20,
+	}
+	sr := limiter.SendReceiver(ctx.SetGoContext(gctx).WithSendRecv(false, false, false))
+
+Interceptors added to a Context with Use() wrap every Send, Recv, Ack, Nak and resume tpipe
+exchange. A Call gives access to the IRM header and the segments before they are written, and
+to the response after it is received. An interceptor that doesn't invoke next stubs IMS connect:
+
+	ctx.Use(func(next ims.Exchange) ims.Exchange {
+		return func(call *ims.Call) error {
+			err := next(call)
+			if call.Op == ims.OpRecv && err == nil {
+				call.Response.OnComplete(func(r *ims.Response, err error) {
+					log.Println("response complete:", err)
+				})
+			}
+			return err
+		}
+	})
+
+The otelimstm module traces the exchanges with OpenTelemetry, using such an interceptor.
+SetGoContext sets the context.Context carrying the parent span:
+
+	ctx.Use(otelimstm.Interceptor()).SetGoContext(gctx)
+
+An Observer set with SetObserver, or on a Session, observes the connects, disconnects, exchanges
+and acknowledgements of the sessions. The promimstm module collects Prometheus metrics with it:
+
+	collector, err := promimstm.Register(prometheus.DefaultRegisterer)
+
+A Session logs to a Logger, like *slog.Logger, when set. WireDump logs the requests and the
+response segments in hex and EBCDIC, always masking the racf password and the MaskFields:
+
+	sess.Logger = slog.Default()
+	sess.WireDump = true
+	sess.MaskFields = []ims.MaskField{{Segment: 0, Offset: 9, Length: 16}}
+
+A Recorder captures the traffic of a session into a capture file, masking the racf credentials.
+A ReplayServer serves the captured responses to the matching requests, e.g. in unit tests:
+
+	sess.WrapConn = ims.NewRecorder(file).Wrap
+
+	frames, err := ims.LoadCapture(file)
+	server := &ims.ReplayServer{Frames: frames}
+	err = server.Start("127.0.0.1:0")
+	sess := &ims.Session{Addr: server.Addr()}
+
+The IRM header is sent with the lowest architecture carrying the fields in use. IRM extensions
+set with SetExtensions follow the header. IRMHeader.UnmarshalBinary decodes the extensions as
+*RawIRMExtension, as their layouts are site and release specific.
+
+The Exit of a Session is the user message exit of the IMS connect port, HWSSMPL1 by default.
+HWSSMPL0 output is not prefixed by the total length. HWSJAVA0 is the exit of the IMS TM
+resource adapter, which lets the Go services share the ports and the racf security setup of
+the Java EE applications; its SYNC_SEND_RECEIVE, SYNC_SEND and SYNC_RECEIVE_ASYNCOUTPUT
+interactions are the WithSendRecv, WithSendOnly and WithRecvOnly contexts. A CustomExit sends
+the site specific user portion of the IRM:
+
+	sess.Exit = &ims.CustomExit{Identifier: "*MYEXIT*", User: user, EndTrailer: ims.RequestTrailer}
+
+The credentials masked in the wire dumps and the captures are located by the exits implementing
+CredentialExit, like the Secrets of a CustomExit. The whole user portion of the IRM is masked for
+the other exits.
+
+WithOTMA sends the OTMA headers built by the client, for control over the commit mode, the sync
+level, the security scope and the user data read by the IMS application:
+
+	sr := ctx.WithOTMA(ims.OTMAHeaders{
+		Architecture:  level,
+		CommitMode:    ims.OTMACM1,
+		SyncLevel:     ims.OTMASyncConfirm,
+		SecurityScope: ims.OTMASecCheck,
+		Userid:        "USER1234",
+		UserData:      routing,
+	})
+
+Begin starts a branch of a global transaction identified by the XID of an external transaction
+manager, to coordinate the IMS updates with the other resources using the two-phase commit.
+The transactions are sent under the XID with sync level SYNCPT; Recover lists the in-doubt XIDs.
+The Exit of the session must be an XAExit, like HWSJAVA0, which encodes the verbs and the XID:
+
+	tx, err := ctx.Begin(ims.XID{FormatID: 1, GTRID: gtrid, BQUAL: bqual})
+	sr := tx.SendRecv()
+	//send and receive the transactions, write to the other resources
+	if err := tx.Prepare(); err != nil {
+		return tx.Rollback()
+	}
+	return tx.Commit()
+
 Communication with IMS connect can be started only by switching context.
+SendRecv, SendOnly and RecvOnly switch the context with named options, validating their
+combination, and return *OptionError for the invalid ones:
+
+	sr, err := ctx.SendRecv(ims.CM0(), ims.Sync(ims.SyncConfirm), ims.PurgeUndelivered(), ims.NoWaitAck())
+	receiver, err := ctx.RecvOnly(ims.SingleMessage(), ims.NoWait())
+
+Expire lets IMS connect set the expiration of the transaction; the expired ones fail with an
+error matching ErrTranExpired. DFS2082 returns *DFS2082Error from Out(), when a CM0 transaction
+doesn't reply. The Ack() of CM0 output waits for the reply of IMS connect, unless NoWaitAck is set:
+
+	sr, err := ctx.SendRecv(ims.CM0(), ims.Expire(), ims.DFS2082())
+	if _, err := resp.Out(true); errors.Is(err, ims.ErrTranExpired) {
+		//resend or report
+	}
+
 Context has implementations for different IMS connect communication protocols:
 
 1. Send-Receive using CM0 (commit-then-send) and CM1 (send-then-commit) protocol
@@ -73,6 +225,28 @@ to deal with conversational and non-conversational transactions,
 		}
 	}
 
+WithSyncLevel sets the sync level - SyncNone or SyncConfirm - of the output; SyncPoint is
+reserved to Tx.SendRecv. Response.Confirmation() tells whether the output has to be acknowledged
+with Ack() or Nak(..), or is confirmed by the commit of a global transaction:
+
+	sr := ctx.WithSyncLevel(ims.SyncConfirm, false, false)
+
+For high volume or binary outputs, the segments can be iterated as they are read,
+without collecting the whole message in memory. PooledSegments() additionally reuses
+a pooled read buffer across the segments:
+
+	it := resp.PooledSegments()
+	defer it.Release()
+	for it.Next() {
+		seg := it.Segment()
+		if seg.Type == ims.RESPSEGDATA {
+			process(seg.Data) //valid only till the next call to Next()
+		}
+	}
+	if err := it.Err(); err != nil {
+		//handle error
+	}
+
 2. Sendonly protocol to continuously send messages to a non-response mode transaction.
 Outupt of the messages sent to a response mode transactions will end up in the tpipe
 queue of the same name or on the tpipe with reroute clientID set.
@@ -120,6 +294,24 @@ OTMA mandates the acknowledgement for such Async receives from tpipe
 		receiver.Ack()
 	}
 
+A Cluster distributes the sessions over multiple IMS connect instances and datastores,
+using round-robin, least-outstanding or priority based failover policies. Endpoints are
+ejected on connection failures, failed pings and datastore unavailable errors, and are
+eligible again after a cool-down:
+
+	cluster := &ims.Cluster{
+		Endpoints: []ims.Endpoint{
+			{Addr: "10.1.2.3:4567", DataStore: "PRODIMSA", Priority: 0},
+			{Addr: "10.1.2.4:4567", DataStore: "PRODIMSB", Priority: 1},
+		},
+		Policy:         ims.Failover,
+		HealthInterval: 30 * time.Second,
+	}
+	cluster.Start()
+	defer cluster.End()
+
+	sess, err := cluster.Dial()
+
 Please check the individual struct types for additional documentation
 */
 package imstm
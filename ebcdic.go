@@ -60,3 +60,18 @@ func A2E(input []byte) []byte {
 	return converted
 
 }
+
+// CodePage represents the ebcdic code page used for converting the text between ascii and ebcdic
+type CodePage interface {
+	Encode(ascii []byte) []byte  //converts ascii to ebcdic
+	Decode(ebcdic []byte) []byte //converts ebcdic to ascii
+}
+
+// cp037 is the default code page implementation backed by A2E and E2A
+type cp037 struct{}
+
+func (cp037) Encode(ascii []byte) []byte  { return A2E(ascii) }
+func (cp037) Decode(ebcdic []byte) []byte { return E2A(ebcdic) }
+
+// CP037 is the default ebcdic code page (US/Canada) used for the conversions
+var CP037 CodePage = cp037{}
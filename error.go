@@ -1,6 +1,10 @@
 package imstm
 
-import "strconv"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
 
 // returnCodes indicate IMS connect return codes
 var returnCodes map[int]string = map[int]string{
@@ -86,8 +90,57 @@ type ReasonCode int
 
 // String returns the IMS connect response reason code as string
 func (rc ReasonCode) String() string {
-	if str, ok := returnCodes[int(rc)]; ok {
+	if str, ok := reasonCodes[int(rc)]; ok {
 		return str
 	}
 	return "Unknown: " + strconv.Itoa(int(rc))
 }
+
+// disconnectCodes are the return codes after which IMS connect disconnects the socket
+var disconnectCodes = map[ReturnCode]bool{8: true, 12: true, 24: true, 28: true, 32: true, 36: true}
+
+// IMSConnectError represents the error status returned by IMS connect in the
+// Request Status Message (RSM) of the response
+type IMSConnectError struct {
+	ReturnCode ReturnCode //ims connect return code
+	ReasonCode ReasonCode //ims connect reason code, or the OTMA sense code for return code 16
+	RacfRc     byte       //racf reason code for security errors
+}
+
+// Error returns the return and reason codes of the error
+func (e *IMSConnectError) Error() string {
+	return fmt.Sprintf("ErrIMSConnect: ReturnCode: %d, ReasonCode: %d", e.ReturnCode, e.ReasonCode)
+}
+
+// Disconnected reports whether IMS connect disconnected the socket along with this error
+func (e *IMSConnectError) Disconnected() bool {
+	return disconnectCodes[e.ReturnCode]
+}
+
+// senseExpired is the OTMA sense code of the transactions discarded as expired
+const senseExpired ReasonCode = 0x32
+
+// ErrTranExpired indicates that IMS discarded the transaction as expired, when the expiration
+// is set with the Expire option. errors.Is(err, ErrTranExpired) matches such *IMSConnectError
+var ErrTranExpired = errors.New("Transaction expired")
+
+// Expired reports whether OTMA discarded the transaction as expired
+func (e *IMSConnectError) Expired() bool {
+	return e.ReturnCode == 16 && e.ReasonCode == senseExpired
+}
+
+// Is matches ErrTranExpired for the expired transactions
+func (e *IMSConnectError) Is(target error) bool {
+	return target == ErrTranExpired && e.Expired()
+}
+
+// DFS2082Error is returned by Out(), when the IMS application of a CM0 send-receive with the
+// DFS2082 option ends without replying on the IOPCB. Text is the DFS2082 message returned by IMS.
+type DFS2082Error struct {
+	Text string
+}
+
+// Error returns the DFS2082 message
+func (e *DFS2082Error) Error() string {
+	return e.Text
+}
@@ -0,0 +1,127 @@
+package imstm
+
+import (
+	"context"
+	"strconv"
+)
+
+// Op is the operation of an exchange with IMS connect
+type Op int
+
+// List of exchange operations
+const (
+	OpSend   Op = iota //send a message
+	OpResume           //resume tpipe request
+	OpRecv             //receive the response
+	OpAck              //acknowledge positively
+	OpNak              //acknowledge negatively
+)
+
+var opNames = map[Op]string{
+	OpSend:   "Send",
+	OpResume: "Resume",
+	OpRecv:   "Recv",
+	OpAck:    "Ack",
+	OpNak:    "Nak",
+}
+
+// String returns the name of the operation
+func (op Op) String() string {
+	if str, ok := opNames[op]; ok {
+		return str
+	}
+	return "Unknown: " + strconv.Itoa(int(op))
+}
+
+// Call is a single exchange passed through the interceptors of a Context
+type Call struct {
+	Op        Op
+	Context   *Context
+	GoContext context.Context //context of the caller, as set by Context.SetGoContext
+	IRM       *IRMHeader      //irm header of the request, nil for OpRecv
+	Segments  [][]byte        //message segments of OpSend
+	OTMA      []byte          //client built otma headers of OpSend, following the irm header
+	XID       []byte          //X/Open identifier of OpSend under a global transaction
+	ASCII     bool            //segments need ascii to ebcdic conversion
+	Response  *Response       //response of OpRecv, set by the exchange and not read yet
+	Written   int             //bytes written by OpSend, OpResume, OpAck and OpNak, set by the exchange
+
+	expect bool //response is expected for the request
+}
+
+// Exchange performs a call. The innermost Exchange of a Context checks the state of the session
+// and does the network I/O, writing Call.IRM and Call.Segments, or reading Call.Response
+type Exchange func(call *Call) error
+
+// Interceptor wraps an Exchange. It can inspect or modify the call before invoking next,
+// inspect the response and error after, or not invoke next at all, e.g. to stub IMS connect.
+//
+// The Call.Response of OpRecv is handed over unread, as the caller streams the segments after
+// Recv() returns. Its Status() and the IMS connect error of the RSM segment are known only once
+// it's completely read, so an interceptor observes the outcome with Response.OnComplete, rather
+// than reading the segments itself.
+type Interceptor func(next Exchange) Exchange
+
+// Use appends the interceptors to the chain of the context.
+// The interceptor added first is the outermost one
+func (ctx *Context) Use(interceptors ...Interceptor) *Context {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.chain = append(ctx.chain[:len(ctx.chain):len(ctx.chain)], interceptors...)
+	return ctx
+}
+
+// exchange performs the call through the interceptors of the context
+func (ctx *Context) exchange(call *Call, terminal Exchange) error {
+	ctx.mu.Lock()
+	chain := ctx.chain
+	ctx.mu.Unlock()
+	call.Context = ctx
+	call.GoContext = ctx.goContext()
+	next := terminal
+	for i := len(chain) - 1; i >= 0; i-- {
+		next = chain[i](next)
+	}
+	err := next(call)
+	if err != nil {
+		ctx.session.anomaly(call.Op, err)
+	}
+	return err
+}
+
+// SetGoContext sets the context.Context of the caller passed to the interceptors, e.g. to carry
+// the parent trace span
+func (ctx *Context) SetGoContext(gctx context.Context) *Context {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.gctx = gctx
+	return ctx
+}
+
+// goContext returns the context.Context set by SetGoContext, defaults to context.Background()
+func (ctx *Context) goContext() context.Context {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.gctx == nil {
+		return context.Background()
+	}
+	return ctx.gctx
+}
+
+// DataStore returns the name of the datastore the call is sent to
+func (c *Call) DataStore() string {
+	return c.Context.key(nil, false).DataStore
+}
+
+// TranCode returns the transaction code of the call, either set on the context
+// or from the first 8 bytes of the message
+func (c *Call) TranCode() string {
+	return c.Context.key(c.Segments, c.ASCII).TranCode
+}
+
+// ClientID returns the client-id of the context, empty if it's generated by IMS connect
+func (c *Call) ClientID() string {
+	c.Context.mu.Lock()
+	defer c.Context.mu.Unlock()
+	return c.Context.ident.clientID
+}
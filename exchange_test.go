@@ -0,0 +1,75 @@
+package imstm
+
+import (
+	"testing"
+)
+
+func TestCallWritten(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+
+	var written []int
+	ctx := NewContext(sess).Use(func(next Exchange) Exchange {
+		return func(call *Call) error {
+			err := next(call)
+			if call.Op != OpRecv {
+				written = append(written, call.Written)
+			}
+			return err
+		}
+	})
+	ctx.SetExtensions(&RawIRMExtension{ID: "*TEST*", Data: []byte("EXTENSION")})
+	sr := ctx.WithOTMA(OTMAHeaders{Architecture: 1, UserData: []byte("ROUTING")})
+	if got := exchangeOut(t, sr, "IN"); got != "OUT" {
+		t.Fatalf("got %q", got)
+	}
+	req := srv.awaitRequests(t, 1)[0]
+	if len(written) != 1 || written[0] != len(req) {
+		t.Fatalf("written %v, want [%d]", written, len(req))
+	}
+}
+
+func TestRecvInterceptor(t *testing.T) {
+	srv := newFakeServer(t, func(req []byte) []byte {
+		return frame(seg(A2E([]byte("OUT"))), rsmSeg(8, 40))
+	})
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+
+	var unread bool
+	var done error
+	ctx := NewContext(sess).Use(func(next Exchange) Exchange {
+		return func(call *Call) error {
+			err := next(call)
+			if call.Op == OpRecv && err == nil {
+				//the response is handed over before the caller reads it
+				unread = !call.Response.Status().Complete
+				call.Response.OnComplete(func(r *Response, err error) {
+					done = err
+				})
+			}
+			return err
+		}
+	})
+	sr := ctx.WithSendRecv(false, false, false)
+	if err := sr.Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sr.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unread {
+		t.Fatal("interceptor got a read response")
+	}
+	if done != nil {
+		t.Fatalf("completed with %v before the read", done)
+	}
+	resp.Out(true)
+	if e, ok := done.(*IMSConnectError); !ok || e.ReturnCode != 8 || e.ReasonCode != 40 {
+		t.Fatalf("completed with %v, want the IMS connect error", done)
+	}
+}
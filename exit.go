@@ -0,0 +1,260 @@
+package imstm
+
+import (
+	"encoding/binary"
+)
+
+// MessageExit is the IMS connect user message exit serving the port. It owns the layout of
+// the IRM header, the trailer of the request and the framing of the output messages.
+type MessageExit interface {
+	// IRMID returns the identifier of the IRM header, like "*SAMPL1*"
+	IRMID() string
+
+	// MarshalIRM encodes the irm header including LLLL, followed by its extensions if any
+	MarshalIRM(irm *IRMHeader) ([]byte, error)
+
+	// Trailer returns the bytes marking the end of the request, nil if there's none
+	Trailer() []byte
+
+	// LengthPrefixed tells if the output messages begin with their total length LLLL
+	LengthPrefixed() bool
+}
+
+// CredentialExit is implemented by the message exits locating the credentials in their requests,
+// which are masked in the wire dumps and the captures. The exits shipped with the package are
+// CredentialExits. As the credentials of the other exits can't be located, the user portion of
+// their IRM header and the prefixes following it are masked altogether.
+type CredentialExit interface {
+	MessageExit
+
+	// Credentials returns the credential fields of the request. The request may end after the
+	// prefixes following the IRM header, without the segments.
+	Credentials(req []byte) []CredentialField
+}
+
+// PrefixExit is implemented by the message exits sending prefixes of their own between the IRM
+// header and the segments, like the XID of an XAExit, to locate the segments of the recorded
+// and the replayed requests. The prefixes of the requests of the other exits are located as per
+// the standard layout, where the client built OTMA headers follow the IRM header.
+type PrefixExit interface {
+	MessageExit
+
+	// PrefixLen returns the length of the prefixes following the IRM header of the request,
+	// -1 if they can't be located
+	PrefixLen(req []byte) int
+}
+
+// CredentialField is a field of the request holding credentials, like the racf password
+type CredentialField struct {
+	Offset int //offset of the field in the request, including LLLL
+	Length int //length of the field
+}
+
+// racfOffset and racfLen locate the racf userid, groupid and password in the standard layout
+const (
+	racfOffset = 60
+	racfLen    = 24
+)
+
+// standardPrefixLen returns the length of the client built OTMA headers following the IRM header,
+// if any. The XID prefix isn't part of the standard layout.
+func standardPrefixLen(req []byte) int {
+	if len(req) < 21 {
+		return -1
+	}
+	switch {
+	case req[20]&IRMF5XID != 0:
+		return -1
+	case req[20]&IRMF5NOTMA != 0:
+		return otmaLen(req, 4+int(binary.BigEndian.Uint16(req[4:6])))
+	}
+	return 0
+}
+
+// otmaCredentials locates the sections of the OTMA security data, if the client built OTMA
+// headers follow the IRM header of the request
+func otmaCredentials(req []byte) []CredentialField {
+	if len(req) < 21 || req[20]&IRMF5NOTMA == 0 || req[20]&IRMF5XID != 0 {
+		return nil
+	}
+	from, to := otmaSecurity(req, 4+int(binary.BigEndian.Uint16(req[4:6])))
+	if from < 0 {
+		return nil
+	}
+	return []CredentialField{{from, to - from}}
+}
+
+// segmentsOffset returns the offset of the first segment of the request, following the IRM
+// header and the prefixes located by the exit, or -1 if the prefixes can't be located
+func segmentsOffset(exit MessageExit, req []byte) int {
+	if len(req) < 6 {
+		return -1
+	}
+	var n int
+	if pe, ok := exit.(PrefixExit); ok {
+		n = pe.PrefixLen(req)
+	} else {
+		n = standardPrefixLen(req)
+	}
+	if n < 0 {
+		return -1
+	}
+	return 4 + int(binary.BigEndian.Uint16(req[4:6])) + n
+}
+
+// standardExit is the message exit using the IRM header layout of the IBM supplied exits
+type standardExit struct {
+	id       string
+	trailer  []byte
+	prefixed bool
+}
+
+// IRMID returns the identifier of the IRM header
+func (e *standardExit) IRMID() string {
+	return e.id
+}
+
+// MarshalIRM encodes the irm header in the standard layout
+func (e *standardExit) MarshalIRM(irm *IRMHeader) ([]byte, error) {
+	return irm.MarshalBinary()
+}
+
+// Credentials locates the credentials in the standard layout
+func (e *standardExit) Credentials(req []byte) []CredentialField {
+	return append([]CredentialField{{racfOffset, racfLen}}, otmaCredentials(req)...)
+}
+
+// Trailer returns the end of message trailer
+func (e *standardExit) Trailer() []byte {
+	return e.trailer
+}
+
+// LengthPrefixed tells if the output begins with LLLL
+func (e *standardExit) LengthPrefixed() bool {
+	return e.prefixed
+}
+
+// IBM supplied message exits
+var (
+	// HWSSMPL0 is the sample exit, whose output messages are not prefixed by the total length
+	HWSSMPL0 MessageExit = &standardExit{id: "*SAMPLE*", trailer: RequestTrailer}
+
+	// HWSSMPL1 is the sample exit, whose output messages are prefixed by the total length.
+	// It's the default exit of a session
+	HWSSMPL1 MessageExit = &standardExit{id: "*SAMPL1*", trailer: RequestTrailer, prefixed: true}
+
+	// HWSJAVA0 is the exit of the IMS TM resource adapter, see javaExit. It's an XAExit
+	HWSJAVA0 MessageExit = javaExit{}
+)
+
+// javaExit is the HWSJAVA0 exit used by the IMS TM resource adapter, which lets the sessions
+// use the same ports and the same racf security setup as the Java EE applications. The IRM
+// header has the identifier *IRMREQ* and the standard layout, while the output messages are
+// prefixed by their total length. The interactions of the resource adapter map to the
+// Context protocols:
+//
+// - SYNC_SEND_RECEIVE to WithSendRecv
+//
+// - SYNC_SEND to WithSendOnly
+//
+// - SYNC_RECEIVE_ASYNCOUTPUT and its single message variants to WithRecvOnly
+//
+// - SYNC_END_CONVERSATION to Context.End of a conversation
+//
+// The requests of a global transaction carry the XID prefix, see MarshalXA.
+type javaExit struct{}
+
+// IRMID returns the identifier of the IRM header
+func (javaExit) IRMID() string {
+	return "*IRMREQ*"
+}
+
+// MarshalIRM encodes the irm header in the standard layout
+func (javaExit) MarshalIRM(irm *IRMHeader) ([]byte, error) {
+	return irm.MarshalBinary()
+}
+
+// Credentials locates the credentials in the standard layout
+func (javaExit) Credentials(req []byte) []CredentialField {
+	return append([]CredentialField{{racfOffset, racfLen}}, otmaCredentials(req)...)
+}
+
+// PrefixLen returns the length of the XID prefix of the requests flagged with IRMF5XID, and
+// of the client built OTMA headers otherwise
+func (javaExit) PrefixLen(req []byte) int {
+	if len(req) < 21 || req[20]&IRMF5XID == 0 {
+		return standardPrefixLen(req)
+	}
+	off := 4 + int(binary.BigEndian.Uint16(req[4:6]))
+	if len(req) < off+2 || binary.BigEndian.Uint16(req[off:off+2]) != javaXALen {
+		return -1
+	}
+	return javaXALen
+}
+
+// Trailer returns the end of message trailer
+func (javaExit) Trailer() []byte {
+	return RequestTrailer
+}
+
+// LengthPrefixed tells if the output begins with LLLL
+func (javaExit) LengthPrefixed() bool {
+	return true
+}
+
+// CustomExit is a site specific message exit, with the fixed portion of the IRM header,
+// i.e. upto the client id, followed by the user portion as is. The user portion replaces
+// the flags, the transaction code and the rest of the standard fields.
+type CustomExit struct {
+	Identifier   string            //identifier of the IRM header
+	User         []byte            //user portion of the IRM header, following the fixed portion
+	EndTrailer   []byte            //trailer of the request, nil if there's none
+	OutputLength bool              //output messages begin with their total length LLLL
+	Secrets      []CredentialField //credentials in the user portion, masked in the dumps and the captures
+}
+
+// IRMID returns the identifier of the IRM header
+func (e *CustomExit) IRMID() string {
+	return e.Identifier
+}
+
+// MarshalIRM encodes the fixed portion of the irm header, followed by the user portion
+func (e *CustomExit) MarshalIRM(irm *IRMHeader) ([]byte, error) {
+	std, err := irm.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	out := append(std[:32:32], e.User...)
+	binary.BigEndian.PutUint16(out[4:6], uint16(len(out)-4))
+	return out, nil
+}
+
+// Credentials returns the credential fields of the user portion and the OTMA security data
+func (e *CustomExit) Credentials(req []byte) []CredentialField {
+	return append(append([]CredentialField(nil), e.Secrets...), otmaCredentials(req)...)
+}
+
+// Trailer returns the trailer of the request
+func (e *CustomExit) Trailer() []byte {
+	return e.EndTrailer
+}
+
+// LengthPrefixed tells if the output begins with LLLL
+func (e *CustomExit) LengthPrefixed() bool {
+	return e.OutputLength
+}
+
+// exit returns the message exit of the session, HWSSMPL1 by default
+func (s *Session) exit() MessageExit {
+	if s.Exit != nil {
+		return s.Exit
+	}
+	return HWSSMPL1
+}
+
+// newResponse returns a new response on the connection, framed as per the message exit
+func (s *Session) newResponse() *Response {
+	resp := NewResponse(s.connection(), s.ReadTimeout)
+	resp.unframed = !s.exit().LengthPrefixed()
+	return resp
+}
@@ -0,0 +1,127 @@
+package imstm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+func TestCustomExitMasked(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	var capture bytes.Buffer
+	exit := &CustomExit{
+		Identifier:   "*MYEXIT*",
+		User:         append(make([]byte, 8), A2E([]byte("MYSECRET"))...),
+		EndTrailer:   RequestTrailer,
+		OutputLength: true,
+		Secrets:      []CredentialField{{Offset: 40, Length: 8}},
+	}
+	rec := NewRecorder(&capture)
+	rec.Exit = exit
+	sess := &Session{Addr: srv.l.Addr().String(), Exit: exit, WrapConn: rec.Wrap}
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sess.End()
+
+	sr := NewContext(sess).WithSendRecv(false, false, false)
+	if err := sr.Send([][]byte{[]byte("IN")}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if req := srv.awaitRequests(t, 1)[0]; !bytes.Equal(req[40:48], A2E([]byte("MYSECRET"))) {
+		t.Fatalf("user portion is %X", req[32:48])
+	}
+	var f Frame
+	if err := json.NewDecoder(&capture).Decode(&f); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.Data[40:48], bytes.Repeat([]byte{maskByte}, 8)) {
+		t.Errorf("secret is recorded as %X", f.Data[40:48])
+	}
+}
+
+func TestJavaExit(t *testing.T) {
+	//the output of HWSJAVA0 is prefixed by its total length
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := &Session{Addr: srv.l.Addr().String(), Exit: HWSJAVA0}
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sess.End()
+
+	ctx := NewContext(sess).SetTranCode("TRAN").SetCredentials("USER", "", "PASSWD")
+	if got := exchangeOut(t, ctx.WithSendRecv(false, false, false), "IN"); got != "OUT" {
+		t.Fatalf("got %q", got)
+	}
+	req := srv.awaitRequests(t, 1)[0]
+	irm := (&IRMHeader{}).init()
+	copy(irm.IrmID[:], A2E([]byte("*IRMREQ*")))
+	irm.F4 = IRMF4SENDRECV
+	irm.F2 = IRMF2CM1
+	irm.F1 = IRMF1CIDREQ | IRMF1MFSREQ
+	//the identity fields are blank, unless set
+	for _, f := range [][]byte{irm.DestID[:], irm.ClientID[:], irm.Lterm[:], irm.Grpid[:],
+		irm.AppName[:], irm.ModName[:], irm.RerouteName[:]} {
+		putField(f, "", CP037)
+	}
+	putField(irm.TranCode[:], "TRAN", CP037)
+	putField(irm.Userid[:], "USER", CP037)
+	putField(irm.Passwd[:], "PASSWD", CP037)
+	head, err := irm.Normalize().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(head[4:], seg(A2E([]byte("IN")))...), RequestTrailer...)
+	if !bytes.Equal(req[4:], want) {
+		t.Errorf("request is\n%X\nwant\n%X", req[4:], want)
+	}
+	if ll := int(binary.BigEndian.Uint32(req[:4])); ll != len(req) {
+		t.Errorf("LLLL is %d, want %d", ll, len(req))
+	}
+}
+
+// opaqueExit is an exit that doesn't locate its credentials
+type opaqueExit struct {
+	MessageExit
+}
+
+func TestMaskCredentials(t *testing.T) {
+	irm := (&IRMHeader{}).init()
+	putField(irm.TranCode[:], "TRAN", CP037)
+	putField(irm.Userid[:], "USER", CP037)
+	putField(irm.Passwd[:], "PASSWD", CP037)
+	head, err := irm.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := append(append(head, seg(A2E([]byte("IN")))...), RequestTrailer...)
+	masked := func(from, to int) []byte {
+		want := append([]byte(nil), req...)
+		copy(want[from:to], bytes.Repeat([]byte{maskByte}, to-from))
+		return want
+	}
+	custom := &CustomExit{Identifier: "*MYEXIT*", Secrets: []CredentialField{{Offset: 36, Length: 8}}}
+	for _, tc := range []struct {
+		name string
+		exit MessageExit
+		want []byte
+	}{
+		{"HWSSMPL0", HWSSMPL0, masked(racfOffset, racfOffset+racfLen)},
+		{"HWSSMPL1", HWSSMPL1, masked(racfOffset, racfOffset+racfLen)},
+		{"HWSJAVA0", HWSJAVA0, masked(racfOffset, racfOffset+racfLen)},
+		{"CustomExit", custom, masked(36, 44)},
+		{"opaque", opaqueExit{HWSSMPL1}, masked(32, len(head))},
+	} {
+		got := append([]byte(nil), req...)
+		maskCredentials(tc.exit, got)
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: masked\n%X\nwant\n%X", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package imstm
+
+// identity holds the persistent configuration of a context, which is retained across the
+// protocol switches. Only the protocol flags of the irm header are reset by a switch.
+type identity struct {
+	clientID  string   //client id for ims connect
+	userid    string   //racf user id
+	grpid     string   //racf group id
+	passwd    string   //racf password
+	appName   string   //racf application name
+	dataStore string   //ims datastore, overrides the session datastore
+	lterm     string   //lterm override
+	reroute   string   //reroute tpipe name
+	tranCode  string   //ims transaction code
+	modName   string   //mfs modname
+	codePage  CodePage //code page for the text conversion
+
+	idempotent bool //messages of the context are safe to be delivered more than once
+	extensions []IRMExtension
+}
+
+// cp returns the code page of the context, defaults to CP037
+func (id *identity) cp() CodePage {
+	if id.codePage == nil {
+		return CP037
+	}
+	return id.codePage
+}
+
+// apply populates the irm header with the identity configuration
+func (id *identity) apply(irm *IRMHeader, session *Session) {
+	dataStore := id.dataStore
+	if dataStore == "" {
+		dataStore = session.DataStore
+	}
+	cp := id.cp()
+	putField(irm.DestID[:], dataStore, cp)
+	putField(irm.ClientID[:], id.clientID, cp)
+	putField(irm.Userid[:], id.userid, cp)
+	putField(irm.Grpid[:], id.grpid, cp)
+	putField(irm.Passwd[:], id.passwd, cp)
+	putField(irm.AppName[:], id.appName, cp)
+	putField(irm.Lterm[:], id.lterm, cp)
+	putField(irm.TranCode[:], id.tranCode, cp)
+	putField(irm.ModName[:], id.modName, cp)
+	putField(irm.RerouteName[:], id.reroute, cp)
+	irm.Extensions = id.extensions
+	if id.reroute != "" {
+		irm.F3 = irm.F3 | IRMF3REROUT
+	} else {
+		irm.F3 = irm.F3 &^ IRMF3REROUT
+	}
+	//the architecture follows the fields in use
+	irm.Arch = IRMARCH0
+	irm.Normalize()
+}
+
+// putField encodes the value into the fixed length irm field, padded with the blanks of the
+// code page as expected by IMS connect. Any earlier value is cleared.
+func putField(field []byte, value string, cp CodePage) {
+	blank := byte('\x40')
+	if b := cp.Encode([]byte(" ")); len(b) == 1 {
+		blank = b[0]
+	}
+	n := copy(field, cp.Encode([]byte(value)))
+	for i := n; i < len(field); i++ {
+		field[i] = blank
+	}
+}
+
+// newIRM initializes a new irm header for the protocol switch, retaining the identity
+func (ctx *Context) newIRM() *IRMHeader {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	irm := (&IRMHeader{}).init()
+	copy(irm.IrmID[:], A2E([]byte(ctx.session.exit().IRMID()+"        ")))
+	ctx.ident.apply(irm, ctx.session)
+	return irm
+}
+
+// set changes the identity and applies it to the current irm header, if any
+func (ctx *Context) set(fn func(id *identity)) *Context {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	fn(&ctx.ident)
+	if ctx.irm != nil {
+		ctx.ident.apply(ctx.irm, ctx.session)
+	}
+	return ctx
+}
+
+// SetReroute sets the reroute tpipe name for the undeliverable CM0 output.
+// For resume tpipe, it's the alternate client id to fetch the messages from
+func (ctx *Context) SetReroute(clientID string) *Context {
+	return ctx.set(func(id *identity) {
+		id.reroute = clientID
+	})
+}
+
+// SetClientID adds the client id to the irm header
+func (ctx *Context) SetClientID(clientID string) *Context {
+	return ctx.set(func(id *identity) {
+		id.clientID = clientID //8-bytes client id
+	})
+}
+
+// SetTranCode adds the transaction id to the irm header
+func (ctx *Context) SetTranCode(tranCode string) *Context {
+	return ctx.set(func(id *identity) {
+		id.tranCode = tranCode //8-bytes transaction code
+	})
+}
+
+// SetLterm adds the lterm override to the iopcb
+func (ctx *Context) SetLterm(lterm string) *Context {
+	return ctx.set(func(id *identity) {
+		id.lterm = lterm //8-bytes ltermoverride
+	})
+}
+
+// SetModName adds the mod name to the iopcb
+func (ctx *Context) SetModName(modName string) *Context {
+	return ctx.set(func(id *identity) {
+		id.modName = modName //8-bytes mod name
+	})
+}
+
+// SetCredentials adds the racf credentials
+func (ctx *Context) SetCredentials(userid string, grpid string, passwd string) *Context {
+	return ctx.set(func(id *identity) {
+		id.userid = userid
+		id.grpid = grpid
+		id.passwd = passwd
+	})
+}
+
+// SetAppName adds the racf application name
+func (ctx *Context) SetAppName(appName string) *Context {
+	return ctx.set(func(id *identity) {
+		id.appName = appName //8-bytes application name
+	})
+}
+
+// SetDataStore overrides the datastore of the session for this context
+func (ctx *Context) SetDataStore(dataStore string) *Context {
+	return ctx.set(func(id *identity) {
+		id.dataStore = dataStore //8-bytes datastore
+	})
+}
+
+// SetCodePage sets the ebcdic code page for the ascii conversion of the irm fields,
+// message segments and the response output. Default is CP037
+func (ctx *Context) SetCodePage(cp CodePage) *Context {
+	return ctx.set(func(id *identity) {
+		id.codePage = cp
+	})
+}
+
+// SetIdempotent marks the transaction messages sent by this context as idempotent, i.e.
+// safe to be processed more than once. A RetryPolicy retries the idempotent messages even
+// after they may have reached IMS
+func (ctx *Context) SetIdempotent(idempotent bool) *Context {
+	return ctx.set(func(id *identity) {
+		id.idempotent = idempotent
+	})
+}
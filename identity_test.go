@@ -0,0 +1,112 @@
+package imstm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// upperCP encodes in upper case, to tell the code page of the context apart from CP037
+type upperCP struct{}
+
+func (upperCP) Encode(ascii []byte) []byte  { return A2E(bytes.ToUpper(ascii)) }
+func (upperCP) Decode(ebcdic []byte) []byte { return E2A(ebcdic) }
+
+func TestIdentitySwitch(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+
+	ctx := NewContext(sess).SetCodePage(upperCP{}).SetClientID("client").
+		SetCredentials("user", "group", "passwd").SetAppName("app").SetDataStore("store").
+		SetLterm("lterm").SetReroute("reroute").SetTranCode("tran")
+
+	//the identity is set once, before the first switch
+	if err := ctx.WithSendOnly(false, false).Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	rcv := ctx.WithRecvOnly(true, false, false)
+	resp, err := rcv.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.Out(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := rcv.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	sr := ctx.WithSendRecv(false, false, false)
+	if err := sr.Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = sr.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.Out(true); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []struct {
+		name   string
+		offset int
+		value  string
+	}{
+		{"ClientID", 24, "CLIENT"},
+		{"DestID", 44, "STORE"},
+		{"Lterm", 52, "LTERM"},
+		{"Userid", 60, "USER"},
+		{"Grpid", 68, "GROUP"},
+		{"Passwd", 76, "PASSWD"},
+		{"AppName", 84, "APP"},
+		{"RerouteName", 92, "REROUTE"},
+	}
+	for _, req := range srv.requests() {
+		if req[35] == IRMF4ACK {
+			continue
+		}
+		for _, f := range fields {
+			want := A2E([]byte(f.value))
+			if got := req[f.offset : f.offset+len(want)]; !bytes.Equal(got, want) {
+				t.Errorf("F4 %02X: %s is %X, want %X", req[35], f.name, got, want)
+			}
+		}
+		if req[34]&IRMF3REROUT == 0 {
+			t.Errorf("F4 %02X: reroute flag is off", req[35])
+		}
+	}
+	if n := len(srv.requests()); n < 3 {
+		t.Fatalf("%d requests, want 3 switches", n)
+	}
+}
+
+func TestPutField(t *testing.T) {
+	field := []byte("XXXXXXXX")
+	putField(field, "AB", CP037)
+	if want := A2E([]byte("AB      ")); !bytes.Equal(field, want) {
+		t.Errorf("field is %X, want %X", field, want)
+	}
+	putField(field, "", CP037)
+	if want := bytes.Repeat([]byte{0x40}, 8); !bytes.Equal(field, want) {
+		t.Errorf("empty field is %X, want %X", field, want)
+	}
+
+	//the ping request is blank padded like any other
+	srv := newFakeServer(t, pong)
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+	if err := sess.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	req := srv.requests()[0]
+	if got, want := req[36:44], A2E([]byte("*PING   ")); !bytes.Equal(got, want) {
+		t.Errorf("tran code is %X, want %X", got, want)
+	}
+	if got, want := req[60:84], bytes.Repeat([]byte{0x40}, 24); !bytes.Equal(got, want) {
+		t.Errorf("credentials are %X, want blanks", got)
+	}
+	if arch := req[6]; arch != IRMARCH0 {
+		t.Errorf("architecture is %02X, blank fields are in use", arch)
+	}
+}
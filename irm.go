@@ -2,13 +2,15 @@ package imstm
 
 import (
 	"encoding/binary"
+	"fmt"
+	"math"
 )
 
 // IRMHeader represents the  header portion of IMS Request Message prefix.
 // It contains the total length of the message, fixed portion of the IRM header and
 // the user defined portion of the IRM header as defined by HWSSMPL0/HWSSMPL1 exit message routines.
-// Note: Currently correlation token is not included as synchronous callout processing is not yet
-// supported
+// The correlation token, session token and extension offset are present only in the
+// higher architectures.
 type IRMHeader struct {
 	//fixed portion of the irm header
 	TotLength      [4]byte //Total length of the message
@@ -39,32 +41,52 @@ type IRMHeader struct {
 	RerouteName [8]byte //reroute tpipe name or alternate client-id for resume tpipe call
 	TagAdapt    [8]byte //name of the adapter that IMS connect calls to convert XML
 	TagMap      [8]byte //name of the converter that XML adapter calls to convert XML
-	ModName     [8]byte //MFS modname for input message
 
 	//correlation token details for synchronous callout messages
-	//currently not supported, hence not exported.
-	ctLen   [2]byte //correlation token length
-	_ctRes1 [2]byte //reserved
-	imsID   [4]byte //IMS system id
-	memTk   [8]byte //OTMA tmember token
-	aweTk   [8]byte //OTMA message token
-	ctTpipe [8]byte //OTMA tpipe name
-	ctUser  [8]byte //user-id specified in ICAL call
-	sesTkn  [8]byte //session value used for ims connect to ims connect connections
-	extnOff [2]byte //offset value from thes start of IRM to the first IRM extension
-	_ctRes2 [2]byte //reserved
+	CTLen       [2]byte //correlation token length
+	_ctRes1     [2]byte //reserved
+	IMSID       [4]byte //IMS system id
+	MemberToken [8]byte //OTMA tmember token
+	AWEToken    [8]byte //OTMA message token
+	CTTpipe     [8]byte //OTMA tpipe name
+	CTUserid    [8]byte //user-id specified in ICAL call
+
+	ModName      [8]byte //MFS modname for input message
+	SessionToken [8]byte //session value used for ims connect to ims connect connections
+	ExtnOffset   [2]byte //offset value from the start of IRM to the first IRM extension
+	_ctRes2      [2]byte //reserved
+
+	//extensions following the user portion, flagged by IRMF0EXTENS
+	Extensions []IRMExtension
 }
 
-// MarshalBinary implements BinaryMarshaler interface to encode the IRM header into byte slice
+// irmMaxLen is the length of the irm header of the highest architecture, including LLLL
+const irmMaxLen = 176
+
+// MarshalBinary implements BinaryMarshaler interface to encode the IRM header into byte slice.
+// The architecture and the length are worked out from the fields in use, as by Normalize,
+// and every field of the architecture is encoded at its offset.
 func (irm *IRMHeader) MarshalBinary() ([]byte, error) {
-	len := binary.BigEndian.Uint16(irm.Length[:]) + 4
-	var maxLen = 124
+	arch, length := irm.layout()
+	exts, err := marshalExtensions(irm.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	extLen := len(exts)
+	if int(length)+extLen > math.MaxUint16 {
+		return nil, &IRMError{"extensions", fmt.Sprintf("%d bytes exceed the length of the header", extLen)}
+	}
+	len := length + 4
+	var maxLen = irmMaxLen
 	out := make([]byte, maxLen)
 
-	//fixed header
-	copy(out[4:6], irm.Length[:])
-	out[6] = irm.Arch
-	out[7] = irm.F0
+	//fixed header, whose length covers the extensions
+	binary.BigEndian.PutUint16(out[4:6], length+uint16(extLen))
+	out[6] = arch
+	out[7] = irm.F0 &^ IRMF0EXTENS
+	if exts != nil {
+		out[7] = out[7] | IRMF0EXTENS
+	}
 	copy(out[8:8+8], irm.IrmID[:])
 	copy(out[16:16+2], irm.NakRsn[:])
 	copy(out[18:18+2], irm._res1[:])
@@ -89,29 +111,226 @@ func (irm *IRMHeader) MarshalBinary() ([]byte, error) {
 	copy(out[92:92+8], irm.RerouteName[:])
 	copy(out[100:100+8], irm.TagAdapt[:])
 	copy(out[108:108+8], irm.TagMap[:])
-	copy(out[116:116+8], irm.ModName[:])
+
+	//correlation token, session token and extensions
+	copy(out[116:116+2], irm.CTLen[:])
+	copy(out[120:120+4], irm.IMSID[:])
+	copy(out[124:124+8], irm.MemberToken[:])
+	copy(out[132:132+8], irm.AWEToken[:])
+	copy(out[140:140+8], irm.CTTpipe[:])
+	copy(out[148:148+8], irm.CTUserid[:])
+	copy(out[156:156+8], irm.ModName[:])
+	copy(out[164:164+8], irm.SessionToken[:])
+	if exts != nil {
+		//the first extension follows the header
+		binary.BigEndian.PutUint16(out[172:172+2], length)
+	}
 
 	if int(len) < maxLen {
-		return out[:len], nil
+		out = out[:len]
+	}
+	return append(out, exts...), nil
+}
+
+// irmArchLen is the length of the irm header, excluding LLLL, for each architecture
+var irmArchLen = map[byte]uint16{
+	IRMARCH0: 0x50,
+	IRMARCH1: 0x60,
+	IRMARCH2: 0x70,
+	IRMARCH3: 0xA0,
+	IRMARCH4: 0xA8,
+	IRMARCH5: 0xAC,
+}
+
+// irmAppNameLen is the length of the IRMARCH0 header with the racf application name
+const irmAppNameLen = 0x58
+
+// Normalize sets the architecture and the length of the header as per the fields in use.
+// The architecture is raised to the lowest one carrying all the fields in use:
+//
+// - IRMARCH1 for the reroute name or the alternate client-id
+//
+// - IRMARCH2 for the XML adapter and converter names
+//
+// - IRMARCH3 for the MFS modname and the correlation token of the callout messages
+//
+// - IRMARCH4 for the session token
+//
+// - IRMARCH5 for the extensions, which also sets IRMF0EXTENS and the extension offset. The
+// length covers the extensions
+//
+// An architecture set higher than needed is retained.
+func (irm *IRMHeader) Normalize() *IRMHeader {
+	arch, length := irm.layout()
+	irm.Arch = arch
+	binary.BigEndian.PutUint16(irm.Length[:], length+uint16(extensionsLen(irm.Extensions)))
+	irm.F0 = irm.F0 &^ IRMF0EXTENS
+	irm.ExtnOffset = [2]byte{}
+	if len(irm.Extensions) > 0 {
+		irm.F0 = irm.F0 | IRMF0EXTENS
+		binary.BigEndian.PutUint16(irm.ExtnOffset[:], length)
+	}
+	return irm
+}
+
+// size returns the length of the encoded header including LLLL and the extensions
+func (irm *IRMHeader) size() int {
+	_, length := irm.layout()
+	return 4 + int(length) + extensionsLen(irm.Extensions)
+}
+
+// layout returns the architecture and the length of the header, as per the fields in use
+func (irm *IRMHeader) layout() (byte, uint16) {
+	arch := IRMARCH0
+	switch {
+	case len(irm.Extensions) > 0:
+		arch = IRMARCH5
+	case !unset(irm.SessionToken[:]):
+		arch = IRMARCH4
+	case !unset(irm.ModName[:]) || !unset(irm.CTLen[:]) || !unset(irm.MemberToken[:]) || !unset(irm.AWEToken[:]):
+		arch = IRMARCH3
+	case !unset(irm.TagAdapt[:]) || !unset(irm.TagMap[:]):
+		arch = IRMARCH2
+	case !unset(irm.RerouteName[:]):
+		arch = IRMARCH1
+	}
+	if _, ok := irmArchLen[irm.Arch]; ok && irm.Arch > arch {
+		arch = irm.Arch
+	}
+	if arch == IRMARCH0 && !unset(irm.AppName[:]) {
+		return arch, irmAppNameLen
+	}
+	return arch, irmArchLen[arch]
+}
+
+// unset tells if the field is not in use, i.e. all the bytes are zeros or EBCDIC blanks
+func unset(b []byte) bool {
+	for _, c := range b {
+		if c != 0 && c != '\x40' {
+			return false
+		}
+	}
+	return true
+}
+
+// IRMError describes an invalid IRM header
+type IRMError struct {
+	Field  string //field of the irm header
+	Reason string //why the field is invalid
+}
+
+// Error returns the description of the invalid field
+func (e *IRMError) Error() string {
+	return "Invalid IRM " + e.Field + ": " + e.Reason
+}
+
+// UnmarshalBinary implements BinaryUnmarshaler interface to decode the IRM header of a request,
+// starting with LLLL. The length is validated against the architecture, and only the fields
+// of the architecture are decoded. The extensions flagged by IRMF0EXTENS are decoded as
+// *RawIRMExtension.
+func (irm *IRMHeader) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return &IRMError{"length", fmt.Sprintf("%d bytes are too short for the fixed portion", len(data))}
+	}
+	length := binary.BigEndian.Uint16(data[4:6])
+	arch := data[6]
+	archLen, ok := irmArchLen[arch]
+	if !ok {
+		return &IRMError{"architecture", fmt.Sprintf("0x%02X is unknown", arch)}
+	}
+	extended := data[7]&IRMF0EXTENS != 0 && length > archLen
+	if length != archLen && !(arch == IRMARCH0 && length == irmAppNameLen) && !extended {
+		return &IRMError{"length", fmt.Sprintf("0x%X doesn't match architecture %d, expected 0x%X", length, arch, archLen)}
+	}
+	end := 4 + int(length)
+	if len(data) < end {
+		return &IRMError{"length", fmt.Sprintf("0x%X exceeds the %d bytes of data", length, len(data))}
+	}
+
+	//padding the data to the highest architecture decodes the absent fields as zeros
+	hdrLen := length
+	if extended {
+		hdrLen = archLen
+	}
+	in := make([]byte, irmMaxLen)
+	copy(in, data[:4+int(hdrLen)])
+
+	*irm = IRMHeader{}
+	copy(irm.TotLength[:], in[0:4])
+	copy(irm.Length[:], in[4:6])
+	irm.Arch = in[6]
+	irm.F0 = in[7]
+	copy(irm.IrmID[:], in[8:8+8])
+	copy(irm.NakRsn[:], in[16:16+2])
+	irm.F5 = in[20]
+	irm.Timeout = in[21]
+	irm.ConnType = in[22]
+	irm.EncodingScheme = in[23]
+	copy(irm.ClientID[:], in[24:24+8])
+
+	irm.F1 = in[32]
+	irm.F2 = in[33]
+	irm.F3 = in[34]
+	irm.F4 = in[35]
+	copy(irm.TranCode[:], in[36:36+8])
+	copy(irm.DestID[:], in[44:44+8])
+	copy(irm.Lterm[:], in[52:52+8])
+	copy(irm.Userid[:], in[60:60+8])
+	copy(irm.Grpid[:], in[68:68+8])
+	copy(irm.Passwd[:], in[76:76+8])
+	copy(irm.AppName[:], in[84:84+8])
+	copy(irm.RerouteName[:], in[92:92+8])
+	copy(irm.TagAdapt[:], in[100:100+8])
+	copy(irm.TagMap[:], in[108:108+8])
+
+	copy(irm.CTLen[:], in[116:116+2])
+	copy(irm.IMSID[:], in[120:120+4])
+	copy(irm.MemberToken[:], in[124:124+8])
+	copy(irm.AWEToken[:], in[132:132+8])
+	copy(irm.CTTpipe[:], in[140:140+8])
+	copy(irm.CTUserid[:], in[148:148+8])
+	copy(irm.ModName[:], in[156:156+8])
+	copy(irm.SessionToken[:], in[164:164+8])
+	copy(irm.ExtnOffset[:], in[172:172+2])
+
+	if ct := binary.BigEndian.Uint16(irm.CTLen[:]); ct != 0 && ct != 40 {
+		return &IRMError{"correlation token", fmt.Sprintf("length %d is invalid, expected 40", ct)}
 	}
-	return out, nil
+	off := binary.BigEndian.Uint16(irm.ExtnOffset[:])
+	if off != 0 && off < archLen {
+		return &IRMError{"extension offset", fmt.Sprintf("0x%X lies within the header of length 0x%X", off, archLen)}
+	}
+	if irm.F0&IRMF0EXTENS != 0 {
+		if off == 0 {
+			return &IRMError{"extension offset", "is missing for the extensions"}
+		}
+		if off > length {
+			return &IRMError{"extension offset", fmt.Sprintf("0x%X exceeds the length 0x%X", off, length)}
+		}
+		exts, err := unmarshalExtensions(data[4+int(off) : end])
+		if err != nil {
+			return err
+		}
+		irm.Extensions = exts
+	}
+	return nil
 }
 
 // IRMARCH constants - architecture types
 const (
 	IRMARCH0 byte = iota //Y:base architectural structure for user portion
 	IRMARCH1             //Y:for user portion of IRM prefix: IRM_REROUT_NM / IRM_RT_ALTCID
-	IRMARCH2             //N:user portion: IRMARCH1 + IRM_TAG_ADAPT + IRM_TAG_MAP
-	IRMARCH3             //N:user portion: IRMARCH2 + ICAL correlation fields + IRM_MODNAME for MFS
-	IRMARCH4             //N:user portion: IRMARCH3 + IRM_SESTKN (session tokens for IMS-IMS connections)
-	IRMARCH5             //N:user portion: IRMARCH4 + IRM_EXTN_OFF + 2-byte reserved field
+	IRMARCH2             //Y:user portion: IRMARCH1 + IRM_TAG_ADAPT + IRM_TAG_MAP
+	IRMARCH3             //Y:user portion: IRMARCH2 + ICAL correlation fields + IRM_MODNAME for MFS
+	IRMARCH4             //Y:user portion: IRMARCH3 + IRM_SESTKN (session tokens for IMS-IMS connections)
+	IRMARCH5             //Y:user portion: IRMARCH4 + IRM_EXTN_OFF + 2-byte reserved field
 )
 
 // IRMF0 constants - represents flags for different IMS connect communication modes
 const (
 	IRMF0XMLTD   byte = 1 << iota //N:request from IMS SOAP g/w, convert XML which has both trancode and data
 	IRMF0XMLD                     //N:request from IMS SOAP g/w, convert XML which has just data
-	IRMF0EXTENS                   //N:message contains one or more IRM extensions
+	IRMF0EXTENS                   //Y:message contains one or more IRM extensions
 	_                             //N:'\x08' not implemented
 	IRMF0NAKRSN                   //Y:NAK message with a reason code
 	IRMF0SYNCNAK                  //Y:NAK message but retain the message on TPIPE queue
@@ -146,8 +365,6 @@ const (
 
 //TODO: IRM header for really user-defined portion
 
-//TODO: re-org IRM_MAP for IRM_XID two-phase commit protocol messages
-
 // IRMF1 represents flags for the user portion of flag F1
 const (
 	IRMF1TRNEXP byte = 1 << iota //expiration time for tx is set by IMS connect
@@ -207,13 +424,3 @@ func (irm *IRMHeader) init() *IRMHeader {
 	irm.Timeout = '\xE9'    //default timeout
 	return irm
 }
-
-// this will update the total length and architecture
-func (irm *IRMHeader) setReroute(id string) *IRMHeader {
-	length := uint16(96)
-	binary.BigEndian.PutUint16(irm.Length[:], length)
-	irm.F3 = irm.F3 | IRMF3REROUT
-	copy(irm.RerouteName[:], A2E([]byte(id)))
-	irm.Arch = IRMARCH2
-	return irm
-}
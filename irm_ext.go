@@ -0,0 +1,112 @@
+package imstm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// IRMExtension is an extension of the IRM header, following the user portion.
+//
+// On the wire, each extension is its length LL, 2 reserved bytes ZZ, the 8 byte EBCDIC
+// identifier and the data of the extension. The first extension is at the extension offset,
+// and the length of the IRM header covers all of them.
+//
+// The layout of the data varies by the extension and the IMS connect release, so no extension
+// type is built in. The extensions decoded by IRMHeader.UnmarshalBinary are *RawIRMExtension,
+// whose data a site specific type can decode with its UnmarshalBinary.
+type IRMExtension interface {
+	// ExtensionID returns the identifier of the extension, like "*IRMEXT*"
+	ExtensionID() string
+
+	// MarshalBinary encodes the data of the extension, excluding LLZZ and the identifier
+	MarshalBinary() ([]byte, error)
+
+	// UnmarshalBinary decodes the data of the extension, excluding LLZZ and the identifier
+	UnmarshalBinary(data []byte) error
+}
+
+// RawIRMExtension is an extension carrying the raw data
+type RawIRMExtension struct {
+	ID   string //identifier of the extension
+	Data []byte //data of the extension
+}
+
+// ExtensionID returns the identifier of the extension
+func (ext *RawIRMExtension) ExtensionID() string {
+	return ext.ID
+}
+
+// MarshalBinary returns the raw data
+func (ext *RawIRMExtension) MarshalBinary() ([]byte, error) {
+	return ext.Data, nil
+}
+
+// UnmarshalBinary retains a copy of the raw data
+func (ext *RawIRMExtension) UnmarshalBinary(data []byte) error {
+	ext.Data = append([]byte(nil), data...)
+	return nil
+}
+
+// extHeadLen is the length of LLZZ and the identifier of an extension
+const extHeadLen = 12
+
+// marshalExtensions encodes the extensions one after another
+func marshalExtensions(exts []IRMExtension) ([]byte, error) {
+	var out []byte
+	for _, ext := range exts {
+		id := ext.ExtensionID()
+		if len(id) > 8 {
+			return nil, &IRMError{"extension", fmt.Sprintf("identifier %q exceeds 8 bytes", id)}
+		}
+		data, err := ext.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if extHeadLen+len(data) > math.MaxUint16 {
+			return nil, &IRMError{"extension", fmt.Sprintf("%d bytes of %s exceed the length", len(data), id)}
+		}
+		var head [extHeadLen]byte
+		binary.BigEndian.PutUint16(head[:2], uint16(extHeadLen+len(data)))
+		copy(head[4:], bytes.Repeat([]byte{'\x40'}, 8))
+		copy(head[4:], A2E([]byte(id)))
+		out = append(append(out, head[:]...), data...)
+	}
+	return out, nil
+}
+
+// extensionsLen returns the length of the encoded extensions
+func extensionsLen(exts []IRMExtension) int {
+	out, _ := marshalExtensions(exts)
+	return len(out)
+}
+
+// unmarshalExtensions decodes the extensions filling data
+func unmarshalExtensions(data []byte) ([]IRMExtension, error) {
+	var exts []IRMExtension
+	for off := 0; off < len(data); {
+		if off+extHeadLen > len(data) {
+			return nil, &IRMError{"extensions", fmt.Sprintf("extension at 0x%X is truncated", off)}
+		}
+		ll := int(binary.BigEndian.Uint16(data[off : off+2]))
+		if ll < extHeadLen || off+ll > len(data) {
+			return nil, &IRMError{"extensions", fmt.Sprintf("extension at 0x%X has invalid length %d", off, ll)}
+		}
+		id := string(bytes.TrimRight(E2A(data[off+4:off+extHeadLen]), " \x00"))
+		ext := &RawIRMExtension{ID: id}
+		if err := ext.UnmarshalBinary(data[off+extHeadLen : off+ll]); err != nil {
+			return nil, err
+		}
+		exts = append(exts, ext)
+		off += ll
+	}
+	return exts, nil
+}
+
+// SetExtensions sets the IRM extensions of the requests
+func (ctx *Context) SetExtensions(exts ...IRMExtension) *Context {
+	return ctx.set(func(id *identity) {
+		id.extensions = exts
+	})
+}
@@ -0,0 +1,61 @@
+package imstm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestIRMExtensions(t *testing.T) {
+	irm := (&IRMHeader{}).init()
+	irm.Extensions = []IRMExtension{
+		&RawIRMExtension{ID: "*EXTA*", Data: []byte{1, 2, 3}},
+		&RawIRMExtension{ID: "*EXTB*"},
+	}
+	out, err := irm.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 4+0xAC+15+12 {
+		t.Fatalf("%d bytes, want %d", len(out), 4+0xAC+15+12)
+	}
+	if length := binary.BigEndian.Uint16(out[4:6]); int(length) != len(out)-4 {
+		t.Fatalf("length 0x%X doesn't cover the extensions", length)
+	}
+	if off := binary.BigEndian.Uint16(out[172:174]); off != 0xAC {
+		t.Fatalf("extension offset is 0x%X, want 0xAC", off)
+	}
+	if out[7]&IRMF0EXTENS == 0 {
+		t.Fatal("IRMF0EXTENS is not set")
+	}
+
+	//the segments following the header are not taken as extensions
+	msg := append(append(out, seg([]byte("DATA"))...), RequestTrailer...)
+	var dec IRMHeader
+	if err := dec.UnmarshalBinary(msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(dec.Extensions) != 2 {
+		t.Fatalf("%d extensions, want 2", len(dec.Extensions))
+	}
+	ext := dec.Extensions[0].(*RawIRMExtension)
+	if ext.ID != "*EXTA*" || !bytes.Equal(ext.Data, []byte{1, 2, 3}) {
+		t.Fatalf("extension is %+v", ext)
+	}
+}
+
+func TestIRMExtensionErrors(t *testing.T) {
+	for _, ext := range []IRMExtension{
+		&RawIRMExtension{ID: "*TOOLONG*"},
+		&RawIRMExtension{ID: "*BIG*", Data: make([]byte, 1<<16)},
+	} {
+		irm := (&IRMHeader{}).init()
+		irm.Extensions = []IRMExtension{ext}
+		_, err := irm.MarshalBinary()
+		var ierr *IRMError
+		if !errors.As(err, &ierr) {
+			t.Errorf("%s: got %v, want *IRMError", ext.ExtensionID(), err)
+		}
+	}
+}
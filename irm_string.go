@@ -0,0 +1,107 @@
+package imstm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// flagNames are the names of the bits of a flag byte, from the lowest bit
+type flagNames [8]string
+
+var (
+	irmF0Names = flagNames{"XMLTD", "XMLD", "EXTENS", "", "NAKRSN", "SYNCNAK", "SYNASYN", "SYNONLY"}
+	irmF1Names = flagNames{"TRNEXP", "NOWAIT", "SOARSP", "UCTC", "UC", "CIDREQ", "MFSREQ", ""}
+	irmF2Names = flagNames{"UNIQCID", "", "", "", "", "CM1", "CM0", ""}
+	irmF3Names = flagNames{"SYNCNF", "SYNCPT", "PURGE", "REROUT", "ORDER", "IPURG", "DFS2082", "CANCID"}
+	irmF5Names = flagNames{"SNGLNWT", "AUTOFLOW", "NAUTFLOW", "XID", "SNGLWT", "", "NTRNSL", "NOTMA"}
+)
+
+// irmF4Names are the names of the message types
+var irmF4Names = map[byte]string{
+	IRMF4SENDRECV: "SENDRECV",
+	IRMF4ACK:      "ACK",
+	IRMF4CANTIMER: "CANTIMER",
+	IRMF4DEALLOC:  "DEALLOC",
+	IRMF4SNDONLYA: "SNDONLYA",
+	IRMF4SYNRESPA: "SYNRESPA",
+	IRMF4SYNRESP:  "SYNRESP",
+	IRMF4NACK:     "NACK",
+	IRMF4RESTPIPE: "RESTPIPE",
+	IRMF4SENDONLY: "SENDONLY",
+}
+
+// format returns the names of the bits set in the flag byte, joined by '|'.
+// The bits without a name are shown in hex.
+func (names flagNames) format(flag byte) string {
+	var set []string
+	for i, name := range names {
+		bit := byte(1) << uint(i)
+		if flag&bit == 0 {
+			continue
+		}
+		if name == "" {
+			name = fmt.Sprintf("0x%02X", bit)
+		}
+		set = append(set, name)
+	}
+	return strings.Join(set, "|")
+}
+
+// String returns the irm header with the flags by their names, like
+// "ARCH=0 LEN=0x50 F4=SENDRECV F1=CIDREQ|MFSREQ F2=CM1 F3=SYNCNF|CANCID TRAN=ORDERTXN".
+// The flags that are not set are omitted, and the racf credentials are never shown.
+func (irm *IRMHeader) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "ARCH=%d LEN=0x%X", irm.Arch, binary.BigEndian.Uint16(irm.Length[:]))
+
+	f4, ok := irmF4Names[irm.F4]
+	if !ok {
+		f4 = fmt.Sprintf("0x%02X", irm.F4)
+	}
+	fmt.Fprintf(&sb, " F4=%s", f4)
+	for _, f := range []struct {
+		name  string
+		flag  byte
+		names flagNames
+	}{
+		{"F0", irm.F0, irmF0Names},
+		{"F1", irm.F1, irmF1Names},
+		{"F2", irm.F2, irmF2Names},
+		{"F3", irm.F3, irmF3Names},
+		{"F5", irm.F5, irmF5Names},
+	} {
+		if f.flag != 0 {
+			fmt.Fprintf(&sb, " %s=%s", f.name, f.names.format(f.flag))
+		}
+	}
+
+	for _, f := range []struct {
+		name  string
+		value []byte
+	}{
+		{"ID", irm.IrmID[:]},
+		{"CLIENT", irm.ClientID[:]},
+		{"TRAN", irm.TranCode[:]},
+		{"DEST", irm.DestID[:]},
+		{"LTERM", irm.Lterm[:]},
+		{"REROUTE", irm.RerouteName[:]},
+		{"MODNAME", irm.ModName[:]},
+	} {
+		if v := bytes.TrimRight(E2A(f.value), "\x00 "); len(v) > 0 {
+			fmt.Fprintf(&sb, " %s=%s", f.name, v)
+		}
+	}
+	if off := binary.BigEndian.Uint16(irm.ExtnOffset[:]); off != 0 {
+		fmt.Fprintf(&sb, " EXTN=0x%X", off)
+	}
+	if len(irm.Extensions) > 0 {
+		ids := make([]string, len(irm.Extensions))
+		for i, ext := range irm.Extensions {
+			ids[i] = ext.ExtensionID()
+		}
+		fmt.Fprintf(&sb, " EXT=%s", strings.Join(ids, "|"))
+	}
+	return sb.String()
+}
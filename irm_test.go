@@ -0,0 +1,165 @@
+package imstm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// archHeaders returns an irm header carrying the fields of each architecture
+func archHeaders() map[string]*IRMHeader {
+	field := func(dst []byte, value string) {
+		putField(dst, value, CP037)
+	}
+	base := func() *IRMHeader {
+		irm := (&IRMHeader{}).init()
+		irm.F4 = IRMF4SENDRECV
+		field(irm.TranCode[:], "TRAN")
+		field(irm.DestID[:], "IMS1")
+		return irm
+	}
+	arch0 := base()
+	appName := base()
+	field(appName.AppName[:], "APP")
+	arch1 := base()
+	field(arch1.RerouteName[:], "REROUTE")
+	arch2 := base()
+	field(arch2.TagAdapt[:], "ADAPTER")
+	arch3 := base()
+	arch3.CTLen = [2]byte{0, 40}
+	copy(arch3.IMSID[:], A2E([]byte("IMSA")))
+	copy(arch3.MemberToken[:], "MEMBER01")
+	copy(arch3.AWEToken[:], "AWETOKEN")
+	field(arch3.CTTpipe[:], "TPIPE")
+	field(arch3.CTUserid[:], "CTUSER")
+	field(arch3.ModName[:], "MODNAME")
+	arch4 := base()
+	copy(arch4.SessionToken[:], "SESSTOKN")
+	arch5 := base()
+	arch5.Extensions = []IRMExtension{&RawIRMExtension{ID: "*EXT*", Data: []byte("DATA")}}
+	return map[string]*IRMHeader{
+		"ARCH0": arch0, "ARCH0/APPNAME": appName, "ARCH1": arch1, "ARCH2": arch2,
+		"ARCH3": arch3, "ARCH4": arch4, "ARCH5": arch5,
+	}
+}
+
+func TestIRMRoundTrip(t *testing.T) {
+	for name, irm := range archHeaders() {
+		irm.Normalize()
+		out, err := irm.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var dec IRMHeader
+		if err := dec.UnmarshalBinary(out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(&dec, irm) {
+			t.Errorf("%s: decoded\n%+v\nwant\n%+v", name, dec, *irm)
+		}
+	}
+}
+
+func TestIRMString(t *testing.T) {
+	irm := (&IRMHeader{}).init()
+	irm.F1 = IRMF1CIDREQ | IRMF1MFSREQ
+	irm.F2 = IRMF2CM1
+	irm.F3 = irm.F3 | IRMF3SYNCNF
+	irm.F4 = IRMF4SENDRECV
+	putField(irm.TranCode[:], "ORDERTXN", CP037)
+	putField(irm.Userid[:], "USER", CP037)
+	putField(irm.Passwd[:], "SECRET", CP037)
+	irm.Normalize()
+
+	want := "ARCH=0 LEN=0x50 F4=SENDRECV F1=CIDREQ|MFSREQ F2=CM1 F3=SYNCNF|CANCID F5=NTRNSL " +
+		"ID=*SAMPL1* TRAN=ORDERTXN"
+	if got := irm.String(); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	//unnamed bits, unknown message types and the extensions
+	irm.F0 = 0x08
+	irm.F4 = 0xFF
+	irm.Extensions = []IRMExtension{&RawIRMExtension{ID: "*EXTA*"}, &RawIRMExtension{ID: "*EXTB*"}}
+	irm.Normalize()
+	got := irm.String()
+	for _, part := range []string{"ARCH=5 LEN=0xC4", "F4=0xFF", "F0=EXTENS|0x08", "EXTN=0xAC", "EXT=*EXTA*|*EXTB*"} {
+		if !strings.Contains(got, part) {
+			t.Errorf("%s doesn't contain %s", got, part)
+		}
+	}
+	if strings.Contains(got, "USER") || strings.Contains(got, "SECRET") {
+		t.Errorf("%s shows the credentials", got)
+	}
+}
+
+func TestIRMLayout(t *testing.T) {
+	headers := archHeaders()
+	for _, tc := range []struct {
+		name   string
+		arch   byte
+		length int //length excluding LLLL and the extensions
+	}{
+		{"ARCH0", IRMARCH0, 0x50},
+		{"ARCH0/APPNAME", IRMARCH0, 0x58},
+		{"ARCH1", IRMARCH1, 0x60},
+		{"ARCH2", IRMARCH2, 0x70},
+		{"ARCH3", IRMARCH3, 0xA0},
+		{"ARCH4", IRMARCH4, 0xA8},
+		{"ARCH5", IRMARCH5, 0xAC},
+	} {
+		out, err := headers[tc.name].MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		exts := 0
+		if tc.arch == IRMARCH5 {
+			exts = 12 + 4
+		}
+		if out[6] != tc.arch {
+			t.Errorf("%s: architecture is %d, want %d", tc.name, out[6], tc.arch)
+		}
+		if ll := int(out[4])<<8 | int(out[5]); ll != tc.length+exts {
+			t.Errorf("%s: length is 0x%X, want 0x%X", tc.name, ll, tc.length+exts)
+		}
+		if len(out) != 4+tc.length+exts {
+			t.Errorf("%s: %d bytes, want %d", tc.name, len(out), 4+tc.length+exts)
+		}
+	}
+
+	//the fields of the higher architectures at their offsets
+	golden := func(name string, off int, want []byte) {
+		out, err := headers[name].MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := out[off : off+len(want)]; !bytes.Equal(got, want) {
+			t.Errorf("%s: bytes at %d are %X, want %X", name, off, got, want)
+		}
+	}
+	golden("ARCH0/APPNAME", 84, A2E([]byte("APP     ")))
+	golden("ARCH1", 92, A2E([]byte("REROUTE ")))
+	golden("ARCH2", 100, A2E([]byte("ADAPTER ")))
+	golden("ARCH3", 116, append([]byte{0, 40, 0, 0}, A2E([]byte("IMSA"))...))
+	golden("ARCH3", 124, []byte("MEMBER01AWETOKEN"))
+	golden("ARCH3", 140, A2E([]byte("TPIPE   CTUSER  MODNAME ")))
+	golden("ARCH4", 156, append(make([]byte, 8), "SESSTOKN"...))
+	golden("ARCH5", 164, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0xAC, 0, 0, 0, 16, 0, 0})
+	golden("ARCH5", 180, append(A2E([]byte("*EXT*   ")), "DATA"...))
+	if out, _ := headers["ARCH4"].MarshalBinary(); len(out) != irmMaxLen-4 {
+		t.Errorf("ARCH4 is %d bytes, want %d", len(out), irmMaxLen-4)
+	}
+
+	//an architecture set higher than needed is retained, a lower one is raised
+	irm := headers["ARCH0"]
+	irm.Arch = IRMARCH2
+	if irm.Normalize(); irm.Arch != IRMARCH2 {
+		t.Errorf("architecture is lowered to %d", irm.Arch)
+	}
+	irm = headers["ARCH3"]
+	irm.Arch = IRMARCH1
+	if irm.Normalize(); irm.Arch != IRMARCH3 {
+		t.Errorf("architecture is %d, want raised to 3", irm.Arch)
+	}
+}
@@ -0,0 +1,237 @@
+package imstm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited indicates that the request is not sent, as it exceeds the limits of the Limiter
+var ErrRateLimited = errors.New("Rate limit exceeded")
+
+// Rate is a token bucket rate limit
+type Rate struct {
+	PerSecond float64 //messages per second, non-positive is unlimited
+	Burst     int     //maximum burst of messages. Defaults to 1
+}
+
+// bucket is the token bucket of a rate
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated till now and returns the wait for a token
+func (b *bucket) refill(now time.Time) time.Duration {
+	burst := float64(b.rate.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate.PerSecond
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate.PerSecond * float64(time.Second))
+}
+
+// Limiter limits the messages sent, with token bucket rates per transaction code and per
+// datastore, and caps the number of exchanges in flight.
+//
+// The wrapped senders wait for the limits till the context.Context set by SetGoContext on
+// their Context is done, as of each request. A request that can't be sent before the deadline
+// of the context.Context fails fast with ErrRateLimited. With FailFast, the requests never wait.
+// An exchange is in flight till its response is completely read, or abandoned by the Context.
+//
+// A Limiter can be shared by multiple contexts and sessions, and must not be modified once used.
+type Limiter struct {
+	// TranCodes are the rates per transaction code
+	TranCodes map[string]Rate
+
+	// DataStores are the rates per datastore
+	DataStores map[string]Rate
+
+	// MaxInFlight caps the exchanges which are sent but not yet completely received.
+	// Zero is unlimited
+	MaxInFlight int
+
+	// FailFast fails the requests exceeding the limits with ErrRateLimited, without waiting
+	FailFast bool
+
+	mu       sync.Mutex
+	once     sync.Once
+	buckets  map[string]*bucket
+	inflight chan struct{}
+}
+
+// Sender returns a Sender limiting the messages sent by s
+func (l *Limiter) Sender(s Sender) Sender {
+	ls := &limitSender{limiter: l, s: s}
+	if c, ok := s.(contexter); ok {
+		ls.ctx = c.context()
+	}
+	return ls
+}
+
+// SendReceiver returns a SendReceiver limiting the messages sent by sr
+func (l *Limiter) SendReceiver(sr SendReceiver) SendReceiver {
+	return &limitSendRecv{limitSender: l.Sender(sr).(*limitSender), sr: sr}
+}
+
+// wait waits for the tokens of the key and then for an in-flight slot, and returns the
+// function releasing the slot
+func (l *Limiter) wait(gctx context.Context, key BreakerKey) (func(), error) {
+	l.once.Do(func() {
+		if l.MaxInFlight > 0 {
+			l.inflight = make(chan struct{}, l.MaxInFlight)
+		}
+	})
+
+	for {
+		delay := l.take(key)
+		if delay == 0 {
+			break
+		}
+		deadline, ok := gctx.Deadline()
+		if l.FailFast || (ok && time.Now().Add(delay).After(deadline)) {
+			return nil, ErrRateLimited
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-gctx.Done():
+			timer.Stop()
+			return nil, gctx.Err()
+		}
+	}
+
+	if l.inflight == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.inflight <- struct{}{}:
+	default:
+		if l.FailFast {
+			return nil, ErrRateLimited
+		}
+		select {
+		case l.inflight <- struct{}{}:
+		case <-gctx.Done():
+			return nil, gctx.Err()
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.inflight })
+	}, nil
+}
+
+// take takes a token from all the buckets of the key, or returns the wait for the tokens
+func (l *Limiter) take(key BreakerKey) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var buckets []*bucket
+	if b := l.bucket("tran:"+key.TranCode, l.TranCodes[key.TranCode]); b != nil {
+		buckets = append(buckets, b)
+	}
+	if b := l.bucket("ds:"+key.DataStore, l.DataStores[key.DataStore]); b != nil {
+		buckets = append(buckets, b)
+	}
+
+	now := time.Now()
+	var delay time.Duration
+	for _, b := range buckets {
+		if d := b.refill(now); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		return delay
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0
+}
+
+// bucket returns the token bucket of the rate, nil if the rate is unlimited
+func (l *Limiter) bucket(name string, rate Rate) *bucket {
+	if rate.PerSecond <= 0 {
+		return nil
+	}
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	b, ok := l.buckets[name]
+	if !ok {
+		b = &bucket{rate: rate}
+		l.buckets[name] = b
+	}
+	return b
+}
+
+// limitSender is the Sender limited by a Limiter
+type limitSender struct {
+	limiter *Limiter
+	s       Sender
+	ctx     *Context
+}
+
+func (s *limitSender) context() *Context { return s.ctx }
+
+// Send waits for the limits and sends the message. The in-flight slot is released once the
+// response of the context is complete, right away if no response is expected
+func (s *limitSender) Send(segments [][]byte, ascii bool) error {
+	gctx := context.Background()
+	var key BreakerKey
+	if s.ctx != nil {
+		gctx = s.ctx.goContext()
+		key = s.ctx.key(segments, ascii)
+	} else {
+		key.TranCode = tranCodeOf(segments, ascii, CP037)
+	}
+	release, err := s.limiter.wait(gctx, key)
+	if err != nil {
+		return err
+	}
+	if err := s.s.Send(segments, ascii); err != nil {
+		release()
+		return err
+	}
+	if s.ctx == nil {
+		release()
+		return nil
+	}
+	s.ctx.onSettled(release)
+	return nil
+}
+
+// limitSendRecv is the SendReceiver limited by a Limiter
+type limitSendRecv struct {
+	*limitSender
+	sr SendReceiver
+}
+
+// Recv receives the response
+func (s *limitSendRecv) Recv() (*Response, error) {
+	return s.sr.Recv()
+}
+
+// Ack acknowledges the response positively
+func (s *limitSendRecv) Ack() error {
+	return s.sr.Ack()
+}
+
+// Nak acknowledges the response negatively
+func (s *limitSendRecv) Nak(reason uint16, retainMsg bool) error {
+	return s.sr.Nak(reason, retainMsg)
+}
@@ -0,0 +1,66 @@
+package imstm
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterGoContext(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+
+	limiter := &Limiter{TranCodes: map[string]Rate{"TRAN": {PerSecond: 1}}}
+	ctx := NewContext(sess).SetTranCode("TRAN")
+	sr := limiter.SendReceiver(ctx.WithSendRecv(false, false, false))
+	if got := exchangeOut(t, sr, "IN"); got != "OUT" {
+		t.Fatalf("got %q", got)
+	}
+
+	//the go context set after wrapping governs the wait of the next request
+	gctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ctx.SetGoContext(gctx)
+	if err := sr.Send(nil, false); err != ErrRateLimited {
+		t.Fatalf("got %v, want ErrRateLimited", err)
+	}
+}
+
+func TestLimiterInFlight(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	one, two := srv.session(t), srv.session(t)
+	defer one.End()
+	defer two.End()
+
+	limiter := &Limiter{MaxInFlight: 1, FailFast: true}
+	sr := limiter.SendReceiver(NewContext(one).WithSendRecv(false, false, false))
+	if err := sr.Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	other := limiter.SendReceiver(NewContext(two).WithSendRecv(false, false, false))
+	if err := other.Send(nil, false); err != ErrRateLimited {
+		t.Fatalf("got %v while the exchange is in flight, want ErrRateLimited", err)
+	}
+	resp, err := sr.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.Out(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := exchangeOut(t, other, "IN"); got != "OUT" {
+		t.Fatalf("got %q", got)
+	}
+
+	//the slot of a response that is never read is released as the context ends the session
+	if err := sr.Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	one.End()
+	if got := exchangeOut(t, other, "IN"); got != "OUT" {
+		t.Fatalf("got %q", got)
+	}
+}
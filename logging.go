@@ -0,0 +1,174 @@
+package imstm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Logger is the structured logger of a session. It's satisfied by *slog.Logger.
+// args are the alternating keys and values of the log record.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// MaskField is a field of the message payload masked in the logs
+type MaskField struct {
+	Segment int //index of the data segment in the request or the response message
+	Offset  int //offset of the field in the segment data, excluding LLZZ
+	Length  int //length of the field
+}
+
+// maskByte is the EBCDIC '*', replacing the masked bytes
+const maskByte = '\x5C'
+
+// log logs the event of the session, if the session has a logger
+func (s *Session) log(ev Event) {
+	l := s.Logger
+	if l == nil {
+		return
+	}
+	args := []interface{}{"addr", s.Addr, "datastore", ev.DataStore}
+	switch ev.Type {
+	case EventConnect:
+		l.Info("ims connected", args...)
+	case EventDisconnect:
+		if ev.Err != nil {
+			l.Warn("ims disconnected", append(args, "err", ev.Err)...)
+			return
+		}
+		l.Info("ims disconnected", args...)
+	case EventReconnect:
+		l.Info("ims reconnected", append(args, "attempts", ev.Attempts)...)
+	case EventSend, EventAck, EventNak:
+		args = append(args, "op", ev.Op.String(), "trancode", ev.TranCode, "bytes", ev.Bytes)
+		if ev.Err != nil {
+			l.Warn("ims write failed", append(args, "err", ev.Err)...)
+			return
+		}
+		l.Debug("ims request", append(args, "segments", ev.Segments)...)
+	case EventResponse:
+		args = append(args, "trancode", ev.TranCode, "bytes", ev.Bytes, "segments", ev.Segments,
+			"duration", ev.Duration, "async", ev.Async)
+		if ev.Err != nil {
+			l.Warn("ims exchange failed", append(args, "err", ev.Err)...)
+			return
+		}
+		l.Info("ims exchange", args...)
+	}
+}
+
+// anomaly logs the misuse of the protocol by a context
+func (s *Session) anomaly(op Op, err error) {
+	if s.Logger == nil {
+		return
+	}
+	switch err {
+	case ErrContextBusy, ErrAckPending, ErrInvalidState, ErrResponseIncomplete,
+		ErrNoResponse, ErrAckNotExpected:
+		s.Logger.Warn("ims protocol anomaly", "addr", s.Addr, "op", op.String(), "err", err)
+	}
+}
+
+// dumpRequest logs the request in hex and EBCDIC, with the credentials and the payload fields
+// masked
+func (s *Session) dumpRequest(r *Request) {
+	if s.Logger == nil || !s.WireDump {
+		return
+	}
+	if r.err != nil {
+		return
+	}
+	header := append([]byte(nil), r.header...)
+	binary.BigEndian.PutUint32(header[:4], r.length)
+	maskCredentials(s.exit(), header)
+	s.Logger.Debug("ims wire request header", "dump", dump(header))
+	for i, seg := range r.segments {
+		seg = append([]byte(nil), seg...)
+		s.maskPayload(i, seg[4:])
+		s.Logger.Debug("ims wire request segment", "index", i, "dump", dump(seg))
+	}
+}
+
+// dumpSegment logs the response segment in hex and EBCDIC, with the payload fields masked
+func (s *Session) dumpSegment(r *Response, segType RespSegType, seg []byte) {
+	if s.Logger == nil || !s.WireDump || seg == nil {
+		return
+	}
+	seg = append([]byte(nil), seg...)
+	if segType == RESPSEGDATA && len(seg) >= 4 {
+		s.maskPayload(r.dataSegs, seg[4:])
+	}
+	s.Logger.Debug("ims wire response segment", "type", string(segType), "dump", dump(seg))
+}
+
+// maskPayload masks the configured fields of the data segment
+func (s *Session) maskPayload(index int, data []byte) {
+	for _, f := range s.MaskFields {
+		if f.Segment != index || f.Offset >= len(data) {
+			continue
+		}
+		end := f.Offset + f.Length
+		if end > len(data) {
+			end = len(data)
+		}
+		mask(data[f.Offset:end])
+	}
+}
+
+// maskCredentials masks the credential fields of the request, located by the message exit
+func maskCredentials(exit MessageExit, req []byte) {
+	var fields []CredentialField
+	switch e := exit.(type) {
+	case CredentialExit:
+		fields = e.Credentials(req)
+	default:
+		//the credentials can't be located, the user portion and the prefixes are masked
+		end := segmentsOffset(exit, req)
+		if end < 0 {
+			end = len(req)
+		}
+		fields = []CredentialField{{32, end - 32}}
+	}
+	for _, f := range fields {
+		if f.Offset < 0 || f.Offset >= len(req) {
+			continue
+		}
+		end := f.Offset + f.Length
+		if end > len(req) {
+			end = len(req)
+		}
+		mask(req[f.Offset:end])
+	}
+}
+
+// mask overwrites the bytes with the mask byte
+func mask(b []byte) {
+	for i := range b {
+		b[i] = maskByte
+	}
+}
+
+// dump formats the bytes as lines of offset, hex and the EBCDIC decoded text
+func dump(b []byte) string {
+	var sb strings.Builder
+	text := E2A(b)
+	for off := 0; off < len(b); off += 16 {
+		end := off + 16
+		if end > len(b) {
+			end = len(b)
+		}
+		fmt.Fprintf(&sb, "\n%04X  % -47X  |", off, b[off:end])
+		for _, c := range text[off:end] {
+			if c < 0x20 || c > 0x7E {
+				c = '.'
+			}
+			sb.WriteByte(c)
+		}
+		sb.WriteByte('|')
+	}
+	return sb.String()
+}
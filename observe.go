@@ -0,0 +1,105 @@
+package imstm
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the type of an event observed on a session
+type EventType int
+
+// List of event types
+const (
+	EventConnect    EventType = iota //connection is established
+	EventDisconnect                  //connection is lost, or closed by End()
+	EventReconnect                   //connection is re-established, after Attempts
+	EventAcquire                     //a context acquired the session, after waiting in line for Duration
+	EventRelease                     //a context released the session
+	EventSend                        //a request or resume tpipe is written
+	EventResponse                    //a response is completely read or failed, Duration after the request
+	EventAck                         //a response is acknowledged positively
+	EventNak                         //a response is acknowledged negatively
+)
+
+var eventTypeNames = map[EventType]string{
+	EventConnect:    "Connect",
+	EventDisconnect: "Disconnect",
+	EventReconnect:  "Reconnect",
+	EventAcquire:    "Acquire",
+	EventRelease:    "Release",
+	EventSend:       "Send",
+	EventResponse:   "Response",
+	EventAck:        "Ack",
+	EventNak:        "Nak",
+}
+
+// String returns the name of the event type
+func (t EventType) String() string {
+	if str, ok := eventTypeNames[t]; ok {
+		return str
+	}
+	return "Unknown: " + strconv.Itoa(int(t))
+}
+
+// Event is an event observed on a session
+type Event struct {
+	Type      EventType
+	Session   *Session
+	Op        Op            //operation of the exchange events
+	DataStore string        //ims datastore name
+	TranCode  string        //ims transaction code of the exchange events, if known
+	Bytes     int           //bytes written or read
+	Segments  int           //message segments written or read
+	Duration  time.Duration //duration of the event, as described by the event type
+	Wait      time.Duration //time to the first byte of the response
+	Async     bool          //response is retrieved using resume tpipe
+	Attempts  int           //dial attempts of the reconnect
+	Err       error         //failure, including the IMS connect errors
+}
+
+// Observer observes the events of the sessions, e.g. to collect metrics.
+// Observe is invoked synchronously, at times with the session lock held, hence it must not
+// block or call into the session and its contexts.
+type Observer interface {
+	Observe(ev Event)
+}
+
+// ObserverFunc is an adapter to use a function as an Observer
+type ObserverFunc func(ev Event)
+
+// Observe invokes the function
+func (f ObserverFunc) Observe(ev Event) {
+	f(ev)
+}
+
+// observerHolder holds the default observer in an atomic.Value
+type observerHolder struct {
+	o Observer
+}
+
+var defaultObserver atomic.Value
+
+// SetObserver sets the observer of all the sessions without an Observer of their own.
+// Passing nil removes the observer
+func SetObserver(o Observer) {
+	defaultObserver.Store(observerHolder{o})
+}
+
+// emit logs and passes the event to the observer of the session
+func (s *Session) emit(ev Event) {
+	if ev.DataStore == "" {
+		ev.DataStore = s.DataStore
+	}
+	s.log(ev)
+	o := s.Observer
+	if o == nil {
+		h, _ := defaultObserver.Load().(observerHolder)
+		o = h.o
+	}
+	if o == nil {
+		return
+	}
+	ev.Session = s
+	o.Observe(ev)
+}
@@ -0,0 +1,284 @@
+package imstm
+
+// Option is an option of the protocol a context is switched to by SendRecv, SendOnly
+// and RecvOnly. Each protocol accepts only the options applicable to it.
+type Option struct {
+	key   string //identifies the option regardless of its argument
+	name  string
+	apply func(o *options)
+}
+
+// option returns the option without any argument
+func option(name string, apply func(o *options)) Option {
+	return Option{name, name, apply}
+}
+
+// String returns the name of the option
+func (o Option) String() string {
+	return o.name
+}
+
+// options are the protocol options collected from the Option values
+type options struct {
+	cm0, cm1  bool
+	level     SyncLevel
+	leveled   bool //sync level is set explicitly
+	purge     bool
+	noWait    bool //resume tpipe doesn't wait for new messages
+	noWaitAck bool //cm0 acknowledgement isn't replied
+	ackReq    bool
+	serial    bool
+	single    bool
+	flow      bool
+	expire    bool
+	noText    bool
+	dfs2082   bool
+	conv      bool
+}
+
+// flags returns the IRMF1 and IRMF3 flags of the options, set on top of the protocol flags
+func (o *options) flags() (f1 byte, f3 byte) {
+	if o.noWaitAck {
+		f1 = f1 | IRMF1NOWAIT
+	}
+	if o.expire {
+		f1 = f1 | IRMF1TRNEXP
+	}
+	if o.noText {
+		f1 = f1 | IRMF1SOARSP
+	}
+	if o.purge {
+		f3 = f3 | IRMF3PURGE
+	}
+	if o.dfs2082 {
+		f3 = f3 | IRMF3DFS2082
+	}
+	return f1, f3
+}
+
+// setFlags sets the flags of the options on the irm header of the context
+func (ctx *Context) setFlags(o *options) {
+	f1, f3 := o.flags()
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.irm.F1 = ctx.irm.F1 | f1
+	ctx.irm.F3 = ctx.irm.F3 | f3
+	ctx.conv = o.conv
+}
+
+// OptionError describes an invalid option or an invalid combination of the options
+type OptionError struct {
+	Option string //name of the option
+	Reason string //why the option is invalid
+}
+
+// Error returns the description of the invalid option
+func (e *OptionError) Error() string {
+	return "Invalid option " + e.Option + ": " + e.Reason
+}
+
+// CM0 sends the message in commit mode 0 (commit-then-send). The output is delivered on the
+// tpipe of the client id, and is confirmed with sync level CONFIRM by default.
+func CM0() Option {
+	return option("CM0", func(o *options) { o.cm0 = true })
+}
+
+// CM1 sends the message in commit mode 1 (send-then-commit), the default of SendRecv
+func CM1() Option {
+	return option("CM1", func(o *options) { o.cm1 = true })
+}
+
+// Sync sets the sync level of the send-receive output. SyncPoint is reserved to Tx.SendRecv.
+func Sync(level SyncLevel) Option {
+	return Option{"Sync", "Sync(" + level.String() + ")", func(o *options) { o.level, o.leveled = level, true }}
+}
+
+// PurgeUndelivered purges the undeliverable CM0 output from the tpipe queue
+func PurgeUndelivered() Option {
+	return option("PurgeUndelivered", func(o *options) { o.purge = true })
+}
+
+// NoWait, for resume tpipe, doesn't wait for new messages once the tpipe queue is exhausted
+func NoWait() Option {
+	return option("NoWait", func(o *options) { o.noWait = true })
+}
+
+// NoWaitAck, for CM0 send-receive with sync level CONFIRM, sets the NOWAIT option of IMS connect
+// for the ACK or NAK of the output. IMS connect doesn't reply to such acknowledgements, and Ack()
+// and Nak(..) return as soon as they're written
+func NoWaitAck() Option {
+	return option("NoWaitAck", func(o *options) { o.noWaitAck = true })
+}
+
+// RequireAck requests an acknowledgement from IMS connect for the send-only messages
+func RequireAck() Option {
+	return option("RequireAck", func(o *options) { o.ackReq = true })
+}
+
+// SerialDelivery schedules the send-only messages in order, for the transactions with
+// the serial schedule type
+func SerialDelivery() Option {
+	return option("SerialDelivery", func(o *options) { o.serial = true })
+}
+
+// SingleMessage fetches a single message with each resume tpipe
+func SingleMessage() Option {
+	return option("SingleMessage", func(o *options) { o.single = true })
+}
+
+// Flow fetches the messages on the tpipe continuously, one after the acknowledgement of another
+func Flow() Option {
+	return option("Flow", func(o *options) { o.flow = true })
+}
+
+// Expire lets IMS connect set the expiration time of the transaction, which is discarded
+// by IMS once expired. The exchanges of the expired transactions fail with ErrTranExpired.
+func Expire() Option {
+	return option("Expire", func(o *options) { o.expire = true })
+}
+
+// NoAckText, with RequireAck, returns only the acknowledgement of the send-only message,
+// without any message text
+func NoAckText() Option {
+	return option("NoAckText", func(o *options) { o.noText = true })
+}
+
+// DFS2082, for CM0 send-receive, returns the DFS2082 message even for the non-response mode
+// transactions, when the IMS application doesn't reply on the IOPCB. Out() of such a response
+// fails with *DFS2082Error.
+func DFS2082() Option {
+	return option("DFS2082", func(o *options) { o.dfs2082 = true })
+}
+
+// Conversational declares the transaction as an IMS conversation. The session stays in the
+// conversation after each output, till Context.End() deallocates it.
+func Conversational() Option {
+	return option("Conversational", func(o *options) { o.conv = true })
+}
+
+// collect applies the options, failing the ones not applicable to the protocol
+func collect(protoName string, applicable map[string]bool, opts []Option) (*options, error) {
+	o := &options{}
+	for _, opt := range opts {
+		if opt.apply == nil {
+			return nil, &OptionError{"<nil>", "zero Option"}
+		}
+		if !applicable[opt.key] {
+			return nil, &OptionError{opt.name, "not applicable to " + protoName}
+		}
+		opt.apply(o)
+	}
+	return o, nil
+}
+
+// SendRecv switches the current context into send-recv mode with the options CM0, CM1, Sync,
+// PurgeUndelivered, NoWaitAck, Expire, DFS2082 and Conversational. Without the options, the message
+// is sent in CM1 with sync level NONE. An invalid combination of the options returns
+// *OptionError, and the context is not switched:
+//
+//	sr, err := ctx.SendRecv(ims.CM0(), ims.Sync(ims.SyncConfirm), ims.PurgeUndelivered(),
+//		ims.NoWaitAck())
+//
+// If the context is in the middle of an exchange, ErrContextBusy is returned.
+func (ctx *Context) SendRecv(opts ...Option) (SendReceiver, error) {
+	o, err := collect("send-recv", map[string]bool{"CM0": true, "CM1": true, "Sync": true,
+		"PurgeUndelivered": true, "NoWaitAck": true, "Expire": true, "DFS2082": true,
+		"Conversational": true}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if o.cm0 && o.cm1 {
+		return nil, &OptionError{"CM0", "conflicts with CM1"}
+	}
+	if !o.leveled && o.cm0 {
+		o.level = SyncConfirm
+	}
+	if o.level == SyncPoint {
+		return nil, &OptionError{"Sync(SYNCPT)", "valid only under a global transaction, with Tx.SendRecv"}
+	}
+	if _, ok := syncLevelNames[o.level]; !ok {
+		return nil, &OptionError{"Sync", "unknown sync level " + o.level.String()}
+	}
+	if o.noWaitAck && !o.cm0 {
+		return nil, &OptionError{"NoWaitAck", "valid only with CM0"}
+	}
+	if o.noWaitAck && o.level != SyncConfirm {
+		return nil, &OptionError{"NoWaitAck", "valid only with sync level CONFIRM"}
+	}
+	if o.dfs2082 && !o.cm0 {
+		return nil, &OptionError{"DFS2082", "valid only with CM0"}
+	}
+	if o.conv && o.cm0 {
+		return nil, &OptionError{"Conversational", "valid only with CM1"}
+	}
+	if o.purge && ctx.rerouted() {
+		return nil, &OptionError{"PurgeUndelivered", "conflicts with the reroute name of the context"}
+	}
+
+	sr := ctx.WithSyncLevel(o.level, o.cm0, o.purge).(*ctxSendRecv)
+	if sr.err != nil {
+		return nil, sr.err
+	}
+	ctx.setFlags(o)
+	return sr, nil
+}
+
+// SendOnly switches the current context into send-only mode with the options CM0,
+// PurgeUndelivered, RequireAck, SerialDelivery, Expire and NoAckText. Send-only messages are
+// always sent in commit mode 0. An invalid option returns *OptionError, and the context is not
+// switched.
+//
+// If the context is in the middle of an exchange, ErrContextBusy is returned.
+func (ctx *Context) SendOnly(opts ...Option) (Sender, error) {
+	o, err := collect("send-only", map[string]bool{"CM0": true, "PurgeUndelivered": true,
+		"RequireAck": true, "SerialDelivery": true, "Expire": true, "NoAckText": true}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if o.noText && !o.ackReq {
+		return nil, &OptionError{"NoAckText", "valid only with RequireAck"}
+	}
+	if o.purge && ctx.rerouted() {
+		return nil, &OptionError{"PurgeUndelivered", "conflicts with the reroute name of the context"}
+	}
+
+	s := ctx.WithSendOnly(o.ackReq, o.serial).(*ctxSendOnly)
+	if s.err != nil {
+		return nil, s.err
+	}
+	ctx.setFlags(o)
+	return s, nil
+}
+
+// RecvOnly switches the current context into resume tpipe mode with the options SingleMessage,
+// Flow and NoWait. Without the options, all the messages on the tpipe queue are returned.
+// SingleMessage and Flow are exclusive, and NoWait applies to either of them. An invalid
+// combination of the options returns *OptionError, and the context is not switched.
+//
+// If the context is in the middle of an exchange, ErrContextBusy is returned.
+func (ctx *Context) RecvOnly(opts ...Option) (Receiver, error) {
+	o, err := collect("recv-only", map[string]bool{"SingleMessage": true, "Flow": true,
+		"NoWait": true}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if o.single && o.flow {
+		return nil, &OptionError{"SingleMessage", "conflicts with Flow"}
+	}
+	if o.noWait && !o.single && !o.flow {
+		return nil, &OptionError{"NoWait", "valid only with SingleMessage or Flow"}
+	}
+
+	r := ctx.WithRecvOnly(o.single, o.flow, !o.noWait).(*ctxRecvOnly)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r, nil
+}
+
+// rerouted reports whether the reroute name is set on the context
+func (ctx *Context) rerouted() bool {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.ident.reroute != ""
+}
@@ -0,0 +1,175 @@
+package imstm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCM0Ack(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		noWait bool
+		reply  []byte //reply of IMS connect to the ACK
+		err    bool
+	}{
+		{"Ack", false, frame(csmSeg(0, 0)), false},
+		{"NoWaitAck", true, nil, false},
+		{"AckError", false, frame(rsmSeg(16, 0x31)), true},
+	} {
+		reply := tc.reply
+		srv := newFakeServer(t, func(req []byte) []byte {
+			if req[35] == IRMF4ACK {
+				return reply
+			}
+			return echo("OUT")(req)
+		})
+		sess := srv.session(t)
+		sess.ReadTimeout = time.Second
+
+		opts := []Option{CM0()}
+		if tc.noWait {
+			opts = append(opts, NoWaitAck())
+		}
+		sr, err := NewContext(sess).SendRecv(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sr.Send(nil, false); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := sr.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := resp.Out(true); err != nil {
+			t.Fatal(err)
+		}
+		if st := sess.State(); st != StateAwaitingAck {
+			t.Fatalf("%s: state is %v, want AwaitingAck", tc.name, st)
+		}
+		//the ack returns once IMS connect replies, or once written with NOWAIT
+		err = sr.Ack()
+		var ce *IMSConnectError
+		if tc.err != errors.As(err, &ce) {
+			t.Fatalf("%s: got %v", tc.name, err)
+		}
+		if st := sess.State(); st != StateIdle {
+			t.Fatalf("%s: state is %v, want Idle", tc.name, st)
+		}
+		if err := sr.Ack(); err != ErrAckNotExpected {
+			t.Fatalf("%s: got %v, want ErrAckNotExpected", tc.name, err)
+		}
+
+		reqs := srv.awaitRequests(t, 2)
+		if len(reqs) != 2 || reqs[1][35] != IRMF4ACK {
+			t.Fatalf("%s: %d requests, want the message and the ACK", tc.name, len(reqs))
+		}
+		for _, req := range reqs {
+			if set := req[32]&IRMF1NOWAIT != 0; set != tc.noWait {
+				t.Errorf("%s: NOWAIT of F4 %02X is %v, want %v", tc.name, req[35], set, tc.noWait)
+			}
+			if req[33] != IRMF2CM0 || req[34]&IRMF3SYNCNF == 0 {
+				t.Errorf("%s: F2 %02X and F3 %02X are not CM0 with sync level CONFIRM", tc.name, req[33], req[34])
+			}
+		}
+		sess.End()
+		srv.Close()
+	}
+}
+
+func TestTranExpired(t *testing.T) {
+	for _, tc := range []struct {
+		rc, rsn uint32
+		expired bool
+	}{
+		{16, 0x32, true},
+		{16, 0x31, false},
+		{4, 0x32, false},
+	} {
+		out := frame(rsmSeg(tc.rc, tc.rsn))
+		srv := newFakeServer(t, func(req []byte) []byte {
+			return out
+		})
+		sess := srv.session(t)
+		sr, err := NewContext(sess).SendRecv(Expire())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sr.Send(nil, false); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := sr.Recv()
+		if err == nil {
+			_, err = resp.Out(true)
+		}
+		var ce *IMSConnectError
+		if !errors.As(err, &ce) {
+			t.Fatalf("%d/%d: got %v, want *IMSConnectError", tc.rc, tc.rsn, err)
+		}
+		if got := errors.Is(err, ErrTranExpired); got != tc.expired {
+			t.Errorf("%d/%d: expired is %v, want %v", tc.rc, tc.rsn, got, tc.expired)
+		}
+		sess.End()
+		srv.Close()
+	}
+}
+
+func TestOptionFlags(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+
+	sr, err := NewContext(sess).SendRecv(CM0(), Expire(), DFS2082(), PurgeUndelivered())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sr.Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	req := srv.awaitRequests(t, 1)[0]
+	if req[32]&IRMF1TRNEXP == 0 {
+		t.Errorf("F1 %02X misses TRNEXP", req[32])
+	}
+	if req[34]&(IRMF3DFS2082|IRMF3PURGE) != IRMF3DFS2082|IRMF3PURGE {
+		t.Errorf("F3 %02X misses DFS2082 or PURGE", req[34])
+	}
+
+}
+
+func TestOptionErrors(t *testing.T) {
+	ctx := NewContext(&Session{})
+	for _, opts := range [][]Option{
+		{CM0(), CM1()},
+		{NoWait()},
+		{NoWaitAck()},
+		{CM0(), Sync(SyncNone), NoWaitAck()},
+		{DFS2082()},
+		{RequireAck()},
+		{Option{}},
+	} {
+		_, err := ctx.SendRecv(opts...)
+		var oerr *OptionError
+		if !errors.As(err, &oerr) {
+			t.Errorf("%v: got %v, want *OptionError", opts, err)
+		}
+	}
+}
+
+func TestNoWait(t *testing.T) {
+	ctx := NewContext(&Session{})
+	if _, err := ctx.RecvOnly(SingleMessage(), NoWait()); err != nil {
+		t.Fatal(err)
+	}
+	//the resume tpipe doesn't wait for messages, its acknowledgements are replied
+	if ctx.irm.F5&IRMF5SNGLNWT == 0 || ctx.irm.F1&IRMF1NOWAIT != 0 {
+		t.Errorf("F5 %02X and F1 %02X are not single message without NOWAIT ACK", ctx.irm.F5, ctx.irm.F1)
+	}
+	if _, err := ctx.RecvOnly(SingleMessage(), NoWaitAck()); err == nil {
+		t.Error("NoWaitAck is applicable to resume tpipe")
+	}
+	if _, err := ctx.SendRecv(CM0(), NoWait()); err == nil {
+		t.Error("NoWait is applicable to send-recv")
+	}
+}
@@ -0,0 +1,143 @@
+// Package otelimstm traces the IMS connect exchanges of go-imstm with OpenTelemetry.
+//
+// The tracing is added to a Context as an interceptor, and the spans are parented to the
+// context.Context set on it using SetGoContext:
+//
+//	ctx := ims.NewContext(sess).Use(otelimstm.Interceptor()).SetGoContext(gctx)
+//
+// Send, Resume, Ack and Nak spans end once the request is written. A Recv span ends once the
+// response is completely read, so that it covers the wait for IMS.
+package otelimstm
+
+import (
+	ims "github.com/manikawnth/go-imstm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/manikawnth/go-imstm/otelimstm"
+
+// Span attribute keys
+const (
+	DataStoreKey        = attribute.Key("ims.datastore")
+	TranCodeKey         = attribute.Key("ims.trancode")
+	ClientIDKey         = attribute.Key("ims.client_id")
+	CommitModeKey       = attribute.Key("ims.commit_mode")
+	SyncLevelKey        = attribute.Key("ims.sync_level")
+	BytesSentKey        = attribute.Key("ims.bytes_sent")
+	BytesReceivedKey    = attribute.Key("ims.bytes_received")
+	SegmentsSentKey     = attribute.Key("ims.segments_sent")
+	SegmentsReceivedKey = attribute.Key("ims.segments_received")
+	ReturnCodeKey       = attribute.Key("ims.return_code")
+	ReasonCodeKey       = attribute.Key("ims.reason_code")
+)
+
+// config of the interceptor
+type config struct {
+	provider trace.TracerProvider
+}
+
+// Option configures the interceptor
+type Option func(*config)
+
+// WithTracerProvider sets the tracer provider. Defaults to the global tracer provider
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *config) {
+		c.provider = provider
+	}
+}
+
+// Interceptor returns an interceptor tracing the exchanges of a Context
+func Interceptor(opts ...Option) ims.Interceptor {
+	cfg := config{provider: otel.GetTracerProvider()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	tracer := cfg.provider.Tracer(instrumentationName)
+
+	return func(next ims.Exchange) ims.Exchange {
+		return func(call *ims.Call) error {
+			gctx, span := tracer.Start(call.GoContext, "IMS "+call.Op.String(),
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(requestAttrs(call)...))
+			call.GoContext = gctx
+
+			err := next(call)
+			if call.Op != ims.OpRecv {
+				//bytes actually written, including the prefixes and the trailer
+				span.SetAttributes(BytesSentKey.Int(call.Written))
+			}
+			if err != nil {
+				fail(span, err)
+				span.End()
+				return err
+			}
+			if call.Op == ims.OpRecv && call.Response != nil {
+				call.Response.OnComplete(func(r *ims.Response, err error) {
+					st := r.Status()
+					span.SetAttributes(
+						BytesReceivedKey.Int(st.TotalBytes),
+						SegmentsReceivedKey.Int(st.Segments),
+					)
+					if st.ClientID != "" {
+						span.SetAttributes(ClientIDKey.String(st.ClientID))
+					}
+					if err != nil {
+						fail(span, err)
+					}
+					span.End()
+				})
+				return nil
+			}
+			span.End()
+			return nil
+		}
+	}
+}
+
+// requestAttrs returns the attributes of the call known before the exchange
+func requestAttrs(call *ims.Call) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{DataStoreKey.String(call.DataStore())}
+	if tran := call.TranCode(); tran != "" {
+		attrs = append(attrs, TranCodeKey.String(tran))
+	}
+	if id := call.ClientID(); id != "" {
+		attrs = append(attrs, ClientIDKey.String(id))
+	}
+	irm := call.IRM
+	if irm == nil {
+		return attrs
+	}
+	return append(attrs, CommitModeKey.String(commitMode(irm.F2)), SyncLevelKey.String(syncLevel(irm.F3)),
+		SegmentsSentKey.Int(len(call.Segments)))
+}
+
+// fail records the error on the span, along with the IMS connect return and reason codes
+func fail(span trace.Span, err error) {
+	if e, ok := err.(*ims.IMSConnectError); ok {
+		span.SetAttributes(ReturnCodeKey.Int(int(e.ReturnCode)), ReasonCodeKey.Int(int(e.ReasonCode)))
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// commitMode returns the commit mode of the IRM F2 flags
+func commitMode(f2 byte) string {
+	if f2&ims.IRMF2CM0 != 0 {
+		return "CM0"
+	}
+	return "CM1"
+}
+
+// syncLevel returns the sync level of the IRM F3 flags
+func syncLevel(f3 byte) string {
+	switch {
+	case f3&ims.IRMF3SYNCPT != 0:
+		return "SYNCPT"
+	case f3&ims.IRMF3SYNCNF != 0:
+		return "CONFIRM"
+	}
+	return "NONE"
+}
@@ -0,0 +1,176 @@
+package otelimstm
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	ims "github.com/manikawnth/go-imstm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// segment returns the LLZZ segment of the data
+func segment(data []byte) []byte {
+	b := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint16(b, uint16(len(b)))
+	copy(b[4:], data)
+	return b
+}
+
+// output returns the response message of the segments, prefixed with LLLL
+func output(segs ...[]byte) []byte {
+	out := make([]byte, 4)
+	for _, s := range segs {
+		out = append(out, s...)
+	}
+	binary.BigEndian.PutUint32(out, uint32(len(out)))
+	return out
+}
+
+// csm is the complete status message
+var csm = append([]byte{0, 12, 0, 0}, ims.A2E([]byte("*CSMOKY*"))...)
+
+// rsm returns the request status message with the return and reason codes
+func rsm(rc, rsn uint32) []byte {
+	b := append([]byte{0, 20, 0, 0}, ims.A2E([]byte("*REQSTS*"))...)
+	b = binary.BigEndian.AppendUint32(b, rc)
+	return binary.BigEndian.AppendUint32(b, rsn)
+}
+
+// serve replies to every request with the output, and sends the length of each request
+func serve(t *testing.T, out []byte) (*ims.Session, <-chan int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	lens := make(chan int, 8)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var ll [4]byte
+			if _, err := io.ReadFull(conn, ll[:]); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(ll[:])
+			if _, err := io.CopyN(io.Discard, conn, int64(n)-4); err != nil {
+				return
+			}
+			lens <- int(n)
+			if _, err := conn.Write(out); err != nil {
+				return
+			}
+		}
+	}()
+	sess := &ims.Session{Addr: l.Addr().String(), DataStore: "IMSA"}
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sess.End() })
+	return sess, lens
+}
+
+// exchange sends the message through the interceptor and reads the output
+func exchange(t *testing.T, sess *ims.Session, exp *tracetest.InMemoryExporter) error {
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	gctx, parent := provider.Tracer("test").Start(context.Background(), "parent")
+	defer parent.End()
+
+	ctx := ims.NewContext(sess).Use(Interceptor(WithTracerProvider(provider))).SetGoContext(gctx).
+		SetTranCode("TRAN").SetClientID("CLIENT1")
+	sr := ctx.WithSendRecv(false, false, false)
+	if err := sr.Send([][]byte{[]byte("TRAN IN")}, true); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sr.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = resp.Out(true)
+	return err
+}
+
+// attrs returns the attributes of the span by their keys
+func attrs(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestInterceptor(t *testing.T) {
+	out := output(segment(ims.A2E([]byte("OUTPUT"))), csm)
+	sess, lens := serve(t, out)
+	exp := tracetest.NewInMemoryExporter()
+	if err := exchange(t, sess, exp); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exp.GetSpans()
+	if len(spans) != 3 || spans[0].Name != "IMS Send" || spans[1].Name != "IMS Recv" {
+		t.Fatalf("spans are %v", spans.Snapshots())
+	}
+	send, recv := attrs(spans[0]), attrs(spans[1])
+	for key, want := range map[attribute.Key]attribute.Value{
+		DataStoreKey:    attribute.StringValue("IMSA"),
+		TranCodeKey:     attribute.StringValue("TRAN"),
+		ClientIDKey:     attribute.StringValue("CLIENT1"),
+		CommitModeKey:   attribute.StringValue("CM1"),
+		SyncLevelKey:    attribute.StringValue("NONE"),
+		SegmentsSentKey: attribute.IntValue(1),
+		BytesSentKey:    attribute.IntValue(<-lens),
+	} {
+		if got := send[key]; got != want {
+			t.Errorf("send %s is %v, want %v", key, got.Emit(), want.Emit())
+		}
+	}
+	for key, want := range map[attribute.Key]attribute.Value{
+		DataStoreKey:        attribute.StringValue("IMSA"),
+		BytesReceivedKey:    attribute.IntValue(len(out)),
+		SegmentsReceivedKey: attribute.IntValue(1),
+	} {
+		if got := recv[key]; got != want {
+			t.Errorf("recv %s is %v, want %v", key, got.Emit(), want.Emit())
+		}
+	}
+	parent := spans[2].SpanContext.SpanID()
+	for _, span := range spans[:2] {
+		if span.Parent.SpanID() != parent {
+			t.Errorf("%s isn't parented to the go context", span.Name)
+		}
+		if span.Status.Code != codes.Unset {
+			t.Errorf("%s status is %v", span.Name, span.Status)
+		}
+	}
+}
+
+func TestInterceptorError(t *testing.T) {
+	sess, _ := serve(t, output(rsm(4, 40)))
+	exp := tracetest.NewInMemoryExporter()
+	if err := exchange(t, sess, exp); err == nil {
+		t.Fatal("the IMS connect error isn't returned")
+	}
+
+	spans := exp.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("spans are %v", spans.Snapshots())
+	}
+	recv := spans[1]
+	if recv.Status.Code != codes.Error || len(recv.Events) != 1 {
+		t.Errorf("recv status is %v with %d events, want the recorded error", recv.Status, len(recv.Events))
+	}
+	a := attrs(recv)
+	if a[ReturnCodeKey] != attribute.IntValue(4) || a[ReasonCodeKey] != attribute.IntValue(40) {
+		t.Errorf("return and reason codes are %v and %v", a[ReturnCodeKey].Emit(), a[ReasonCodeKey].Emit())
+	}
+}
@@ -0,0 +1,275 @@
+package imstm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// OTMA commit modes of the state data
+const (
+	OTMACM1 byte = '\x20' //send-then-commit
+	OTMACM0 byte = '\x40' //commit-then-send
+)
+
+// OTMA sync levels of the state data
+const (
+	OTMASyncNone    byte = '\x00' //no confirmation of the output
+	OTMASyncConfirm byte = '\x01' //output is confirmed with ACK or NAK
+	OTMASyncPoint   byte = '\x02' //output is committed by the two-phase commit
+)
+
+// OTMA security scopes of the security data
+const (
+	OTMASecNone  byte = 'N' //no security checking
+	OTMASecCheck byte = 'C' //checks the transactions and the commands
+	OTMASecFull  byte = 'F' //checks the transactions, the commands and the dependent regions
+)
+
+// otma prefix flags of the control data, telling the prefixes present
+const (
+	otmaStateData byte = '\x80'
+	otmaSecData   byte = '\x40'
+	otmaUserData  byte = '\x20'
+	otmaAppData   byte = '\x10'
+)
+
+// otma sizes of the control data and the state data, and the maximum user data
+const (
+	otmaCtlLen      = 32
+	otmaStateLen    = 52
+	otmaMaxUserData = 1022
+)
+
+// OTMAHeaders are the OTMA message prefix built by the client, which IMS connect passes to
+// OTMA as is. The control data, the state data, the security data and the user data prefixes
+// precede the application data segments. The names are encoded in EBCDIC and blank padded.
+//
+// The prefix gives control over the commit mode, the sync level, the security scope and the
+// user data, which is read by the IMS applications, e.g. for custom routing. The architecture
+// level has no default, it's the level of the prefix agreed with the OTMA of the datastore.
+type OTMAHeaders struct {
+	//control data
+	Architecture byte   //architecture level of the prefix, as supported by the OTMA of the datastore
+	Tpipe        string //tpipe name, defaults to the client id
+
+	//state data
+	CommitMode byte   //OTMACM0 or OTMACM1. Defaults to OTMACM1
+	SyncLevel  byte   //OTMASyncNone, OTMASyncConfirm or OTMASyncPoint
+	MapName    string //MFS map name
+	Lterm      string //lterm name of the IOPCB
+
+	//security data
+	SecurityScope byte   //OTMASecNone, OTMASecCheck or OTMASecFull. Defaults to OTMASecNone
+	Userid        string //racf user id
+	Group         string //racf group id
+	UToken        []byte //racf utoken
+
+	//user data
+	UserData []byte //user data read by the IMS application, upto 1022 bytes
+}
+
+// validate validates the options of the headers
+func (h *OTMAHeaders) validate() error {
+	if h.Architecture == 0 {
+		return &IRMError{"OTMA architecture level", "is not set"}
+	}
+	switch h.CommitMode {
+	case 0, OTMACM1, OTMACM0:
+	default:
+		return &IRMError{"OTMA commit mode", fmt.Sprintf("0x%02X is unknown", h.CommitMode)}
+	}
+	switch h.SyncLevel {
+	case OTMASyncNone, OTMASyncConfirm:
+	case OTMASyncPoint:
+		if h.CommitMode == OTMACM0 {
+			return &IRMError{"OTMA sync level", "SYNCPT requires commit mode 1"}
+		}
+	default:
+		return &IRMError{"OTMA sync level", fmt.Sprintf("0x%02X is unknown", h.SyncLevel)}
+	}
+	switch h.SecurityScope {
+	case 0, OTMASecNone, OTMASecCheck, OTMASecFull:
+	default:
+		return &IRMError{"OTMA security scope", fmt.Sprintf("%q is unknown", h.SecurityScope)}
+	}
+	if len(h.UserData) > otmaMaxUserData {
+		return &IRMError{"OTMA user data", fmt.Sprintf("%d bytes exceed %d", len(h.UserData), otmaMaxUserData)}
+	}
+	if len(h.UToken) > 255-2 {
+		return &IRMError{"OTMA utoken", fmt.Sprintf("%d bytes are too long", len(h.UToken))}
+	}
+	return nil
+}
+
+// commitMode returns the commit mode, defaulting to CM1
+func (h *OTMAHeaders) commitMode() byte {
+	if h.CommitMode == 0 {
+		return OTMACM1
+	}
+	return h.CommitMode
+}
+
+// MarshalBinary implements BinaryMarshaler interface to encode the OTMA prefixes.
+// The application data flag is always set, as the message segments follow the prefixes.
+func (h *OTMAHeaders) MarshalBinary() ([]byte, error) {
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+
+	//control data
+	out := make([]byte, otmaCtlLen, otmaCtlLen+otmaStateLen+64+len(h.UserData))
+	out[0] = h.Architecture
+	out[1] = '\x80'  //transaction message
+	out[14] = '\xA0' //first and last in chain
+	out[15] = otmaStateData | otmaSecData | otmaAppData
+	blankField(out[6:14], h.Tpipe)
+
+	//state data
+	state := make([]byte, otmaStateLen)
+	binary.BigEndian.PutUint16(state[:2], otmaStateLen)
+	state[3] = h.commitMode() | h.SyncLevel
+	blankField(state[4:12], h.MapName)
+	blankField(state[44:52], h.Lterm) //correlator and context id are left to OTMA
+	out = append(out, state...)
+
+	//security data, with sections of length, type and value
+	scope := h.SecurityScope
+	if scope == 0 {
+		scope = OTMASecNone
+	}
+	sec := []byte{0, 0, scope}
+	sec = appendSection(sec, '\x02', h.Userid)
+	sec = appendSection(sec, '\x03', h.Group)
+	if len(h.UToken) > 0 {
+		sec = append(append(sec, byte(len(h.UToken)+2), '\x00'), h.UToken...)
+	}
+	binary.BigEndian.PutUint16(sec[:2], uint16(len(sec)))
+	out = append(out, sec...)
+
+	//user data
+	if len(h.UserData) > 0 {
+		out[15] = out[15] | otmaUserData
+		user := make([]byte, 2, 2+len(h.UserData))
+		binary.BigEndian.PutUint16(user, uint16(2+len(h.UserData)))
+		out = append(out, append(user, h.UserData...)...)
+	}
+	return out, nil
+}
+
+// otmaSecurity returns the offsets of the userid, the group and the utoken sections of the
+// security data in the prefix at off, or -1 if the prefix has no security data
+func otmaSecurity(req []byte, off int) (int, int) {
+	if off < 0 || off+otmaCtlLen > len(req) {
+		return -1, -1
+	}
+	flags := req[off+15]
+	off = off + otmaCtlLen
+	if flags&otmaStateData != 0 {
+		if off+2 > len(req) {
+			return -1, -1
+		}
+		off = off + int(binary.BigEndian.Uint16(req[off:off+2]))
+	}
+	if flags&otmaSecData == 0 || off+3 > len(req) {
+		return -1, -1
+	}
+	end := off + int(binary.BigEndian.Uint16(req[off:off+2]))
+	if end > len(req) || end < off+3 {
+		return -1, -1
+	}
+	return off + 3, end
+}
+
+// otmaLen returns the length of the client built OTMA headers at off, or -1 if they're malformed
+func otmaLen(req []byte, off int) int {
+	if off < 0 || off+otmaCtlLen > len(req) {
+		return -1
+	}
+	flags := req[off+15]
+	end := off + otmaCtlLen
+	for _, prefix := range []byte{otmaStateData, otmaSecData, otmaUserData} {
+		if flags&prefix == 0 {
+			continue
+		}
+		if end+2 > len(req) {
+			return -1
+		}
+		ll := int(binary.BigEndian.Uint16(req[end : end+2]))
+		if ll < 2 {
+			return -1
+		}
+		end = end + ll
+	}
+	if end > len(req) {
+		return -1
+	}
+	return end - off
+}
+
+// blankField encodes the name into the field in EBCDIC, blank padded
+func blankField(field []byte, name string) {
+	for i := range field {
+		field[i] = '\x40'
+	}
+	copy(field, A2E([]byte(name)))
+}
+
+// appendSection appends the security section of the 8-byte name, if set
+func appendSection(sec []byte, typ byte, name string) []byte {
+	if name == "" {
+		return sec
+	}
+	field := make([]byte, 8)
+	blankField(field, name)
+	return append(append(sec, byte(len(field)+2), typ), field...)
+}
+
+// WithOTMA switches the current context into send-recv mode with the OTMA headers built by
+// the client. The prefixes of the headers are sent after the IRM header with IRMF5NOTMA set,
+// and the commit mode and the sync level of the IRM header follow the headers. Invalid
+// headers fail the returned SendReceiver with *IRMError, as does OTMASyncPoint, which is
+// valid only under a global transaction with Tx.SendRecv.
+//
+// If the context is in the middle of an exchange, the context is not switched and the
+// returned SendReceiver fails with ErrContextBusy.
+func (ctx *Context) WithOTMA(headers OTMAHeaders) SendReceiver {
+	sendrecv := &ctxSendRecv{}
+	sendrecv.ctx = ctx
+	if err := ctx.session.switchable(ctx); err != nil {
+		sendrecv.err = err
+		return sendrecv
+	}
+	if headers.SyncLevel == OTMASyncPoint {
+		//as with Sync(SyncPoint), the global transactions are sent by Tx.SendRecv
+		sendrecv.err = &IRMError{"OTMA sync level", "SYNCPT is valid only under a global transaction, with Tx.SendRecv"}
+		return sendrecv
+	}
+	if headers.Tpipe == "" {
+		ctx.mu.Lock()
+		headers.Tpipe = ctx.ident.clientID
+		ctx.mu.Unlock()
+	}
+	prefix, err := headers.MarshalBinary()
+	if err != nil {
+		sendrecv.err = err
+		return sendrecv
+	}
+
+	//initialize irm, retaining the identity of the context
+	irm := ctx.newIRM()
+	irm.F5 = irm.F5 | IRMF5NOTMA
+	irm.F2 = IRMF2CM1
+	if headers.commitMode() == OTMACM0 {
+		irm.F2 = IRMF2CM0
+	}
+	if headers.SyncLevel == OTMASyncConfirm {
+		irm.F3 = irm.F3 | IRMF3SYNCNF
+	}
+	irm.F4 = IRMF4SENDRECV
+
+	ctx.switchTo(protoSendRecv, irm)
+	ctx.mu.Lock()
+	ctx.otma = prefix
+	ctx.mu.Unlock()
+	return sendrecv
+}
@@ -0,0 +1,59 @@
+package imstm
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestOTMAArchitecture(t *testing.T) {
+	if _, err := (&OTMAHeaders{}).MarshalBinary(); err == nil {
+		t.Fatal("headers without the architecture level are encoded")
+	}
+	out, err := (&OTMAHeaders{Architecture: 2}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out[0] != 2 {
+		t.Fatalf("architecture level is %d, want 2", out[0])
+	}
+}
+
+func TestOTMAMasked(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	var capture bytes.Buffer
+	rec := NewRecorder(&capture)
+	sess := &Session{Addr: srv.l.Addr().String(), WrapConn: rec.Wrap}
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sess.End()
+
+	utoken := []byte("SECRETTOKEN")
+	sr := NewContext(sess).WithOTMA(OTMAHeaders{Architecture: 1, Userid: "OTMAUSER", UToken: utoken})
+	if err := sr.Send([][]byte{[]byte("IN")}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	req := srv.awaitRequests(t, 1)[0]
+	if !bytes.Contains(req, A2E([]byte("OTMAUSER"))) || !bytes.Contains(req, utoken) {
+		t.Fatal("security data is not sent")
+	}
+
+	dec := json.NewDecoder(&capture)
+	var f Frame
+	if err := dec.Decode(&f); err != nil || f.Dir != DirRequest {
+		t.Fatal(f.Dir, err)
+	}
+	for _, secret := range [][]byte{A2E([]byte("OTMAUSER")), utoken} {
+		if bytes.Contains(f.Data, secret) {
+			t.Errorf("%X is recorded", secret)
+		}
+	}
+	if !bytes.Contains(f.Data, A2E([]byte("IN"))) {
+		t.Error("payload is masked")
+	}
+}
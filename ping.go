@@ -0,0 +1,44 @@
+package imstm
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrNoPingResponse indicates that IMS connect didn't respond to the ping request
+var ErrNoPingResponse = errors.New("No ping response")
+
+// pingTranCode is the transaction code recognized by the message exits as a ping request
+const pingTranCode = "*PING"
+
+// Ping sends a ping request to IMS connect and validates the ping response.
+// Like any other exchange, the ping waits in line in the queued mode.
+func (s *Session) Ping() error {
+	ctx := NewContext(s)
+	ctx.SetTranCode(pingTranCode)
+	irm := ctx.newIRM()
+	irm.F4 = IRMF4SENDRECV
+	ctx.switchTo(protoSendRecv, irm)
+
+	if err := request(ctx, nil, false, true); err != nil {
+		return err
+	}
+	resp, err := recv(ctx)
+	if err != nil {
+		return err
+	}
+	var pong bool
+	it := resp.PooledSegments()
+	defer it.Release()
+	for it.Next() {
+		seg := it.Segment()
+		if seg.Type == RESPSEGDATA && bytes.Contains(E2A(seg.Data), []byte("PING RESPONSE")) {
+			pong = true
+		}
+	}
+	err = it.Err()
+	if err == nil && !pong {
+		err = ErrNoPingResponse
+	}
+	return err
+}
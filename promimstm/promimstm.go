@@ -0,0 +1,168 @@
+// Package promimstm collects Prometheus metrics of the go-imstm sessions and exchanges.
+//
+// The collector observes all the sessions once registered, without any change to the code
+// using the sessions and contexts:
+//
+//	collector, err := promimstm.Register(prometheus.DefaultRegisterer)
+//
+// A session with an Observer of its own is observed only if the collector is set on it:
+//
+//	sess.Observer = collector
+package promimstm
+
+import (
+	"strconv"
+
+	ims "github.com/manikawnth/go-imstm"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "imstm"
+
+// Collector is a prometheus.Collector and an ims.Observer of the sessions
+type Collector struct {
+	exchangeDuration *prometheus.HistogramVec
+	statusCodes      *prometheus.CounterVec
+	bytesSent        *prometheus.CounterVec
+	bytesReceived    *prometheus.CounterVec
+	activeSessions   *prometheus.GaugeVec
+	busySessions     *prometheus.GaugeVec
+	queueWait        *prometheus.HistogramVec
+	reconnects       *prometheus.CounterVec
+	acks             *prometheus.CounterVec
+	resumeWait       *prometheus.HistogramVec
+}
+
+// New returns a new collector
+func New() *Collector {
+	return &Collector{
+		exchangeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "exchange_duration_seconds",
+			Help:      "Latency from writing the request to completely reading the response.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, []string{"datastore", "trancode", "outcome"}),
+		statusCodes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rsm_total",
+			Help:      "Request status messages returned by IMS connect, by return and reason code.",
+		}, []string{"datastore", "return_code", "reason_code"}),
+		bytesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sent_bytes_total",
+			Help:      "Bytes written to IMS connect.",
+		}, []string{"datastore"}),
+		bytesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "received_bytes_total",
+			Help:      "Bytes read from IMS connect.",
+		}, []string{"datastore"}),
+		activeSessions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sessions_active",
+			Help:      "Sessions connected to IMS connect.",
+		}, []string{"datastore"}),
+		busySessions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sessions_busy",
+			Help:      "Sessions acquired by a context for an exchange.",
+		}, []string{"datastore"}),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "session_queue_wait_seconds",
+			Help:      "Wait of the contexts in line for a busy session.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"datastore"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconnects_total",
+			Help:      "Connections re-established after a loss.",
+		}, []string{"datastore"}),
+		acks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "acknowledgements_total",
+			Help:      "ACK and NAK responses sent to IMS connect.",
+		}, []string{"datastore", "trancode", "type"}),
+		resumeWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "resume_tpipe_wait_seconds",
+			Help:      "Wait for the first byte of the resume tpipe output.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		}, []string{"datastore"}),
+	}
+}
+
+// Register registers a new collector with the registerer and sets it as the observer
+// of all the sessions
+func Register(reg prometheus.Registerer) (*Collector, error) {
+	c := New()
+	if err := reg.Register(c); err != nil {
+		return nil, err
+	}
+	ims.SetObserver(c)
+	return c, nil
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.collectors() {
+		m.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.collectors() {
+		m.Collect(ch)
+	}
+}
+
+func (c *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.exchangeDuration, c.statusCodes, c.bytesSent, c.bytesReceived, c.activeSessions,
+		c.busySessions, c.queueWait, c.reconnects, c.acks, c.resumeWait,
+	}
+}
+
+// Observe implements ims.Observer
+func (c *Collector) Observe(ev ims.Event) {
+	ds := ev.DataStore
+	switch ev.Type {
+	case ims.EventConnect:
+		c.activeSessions.WithLabelValues(ds).Inc()
+	case ims.EventDisconnect:
+		c.activeSessions.WithLabelValues(ds).Dec()
+	case ims.EventReconnect:
+		c.reconnects.WithLabelValues(ds).Inc()
+	case ims.EventAcquire:
+		c.busySessions.WithLabelValues(ds).Inc()
+		c.queueWait.WithLabelValues(ds).Observe(ev.Duration.Seconds())
+	case ims.EventRelease:
+		c.busySessions.WithLabelValues(ds).Dec()
+	case ims.EventSend:
+		c.bytesSent.WithLabelValues(ds).Add(float64(ev.Bytes))
+	case ims.EventAck, ims.EventNak:
+		c.bytesSent.WithLabelValues(ds).Add(float64(ev.Bytes))
+		c.acks.WithLabelValues(ds, ev.TranCode, ev.Type.String()).Inc()
+	case ims.EventResponse:
+		c.bytesReceived.WithLabelValues(ds).Add(float64(ev.Bytes))
+		c.exchangeDuration.WithLabelValues(ds, ev.TranCode, outcome(ev.Err)).Observe(ev.Duration.Seconds())
+		if e, ok := ev.Err.(*ims.IMSConnectError); ok {
+			c.statusCodes.WithLabelValues(ds, strconv.Itoa(int(e.ReturnCode)), strconv.Itoa(int(e.ReasonCode))).Inc()
+		}
+		if ev.Async && ev.Err == nil {
+			c.resumeWait.WithLabelValues(ds).Observe(ev.Wait.Seconds())
+		}
+	}
+}
+
+// outcome returns the outcome label of the exchange
+func outcome(err error) string {
+	switch err.(type) {
+	case nil:
+		return "ok"
+	case *ims.IMSConnectError:
+		return "ims_error"
+	}
+	return "error"
+}
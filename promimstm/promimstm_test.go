@@ -0,0 +1,133 @@
+package promimstm
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	ims "github.com/manikawnth/go-imstm"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// output returns the response message of the segments, prefixed with LLLL
+func output(segs ...[]byte) []byte {
+	out := make([]byte, 4)
+	for _, s := range segs {
+		out = append(out, s...)
+	}
+	binary.BigEndian.PutUint32(out, uint32(len(out)))
+	return out
+}
+
+// csm is the complete status message
+var csm = append([]byte{0, 12, 0, 0}, ims.A2E([]byte("*CSMOKY*"))...)
+
+// rsm returns the request status message with the return and reason codes
+func rsm(rc, rsn uint32) []byte {
+	b := append([]byte{0, 20, 0, 0}, ims.A2E([]byte("*REQSTS*"))...)
+	b = binary.BigEndian.AppendUint32(b, rc)
+	return binary.BigEndian.AppendUint32(b, rsn)
+}
+
+// serve replies to every request with the next of the outputs, on a session observed by the collector
+func serve(t *testing.T, c *Collector, outs ...[]byte) *ims.Session {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, out := range outs {
+			var ll [4]byte
+			if _, err := io.ReadFull(conn, ll[:]); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(ll[:])
+			if _, err := io.CopyN(io.Discard, conn, int64(n)-4); err != nil {
+				return
+			}
+			if _, err := conn.Write(out); err != nil {
+				return
+			}
+		}
+		io.Copy(io.Discard, conn)
+	}()
+	return &ims.Session{Addr: l.Addr().String(), DataStore: "IMSA", Observer: c}
+}
+
+// exchange sends the message and reads the output
+func exchange(t *testing.T, sess *ims.Session, c *Collector) error {
+	sr := ims.NewContext(sess).SetTranCode("TRAN").WithSendRecv(false, false, false)
+	if err := sr.Send([][]byte{[]byte("TRAN IN")}, true); err != nil {
+		t.Fatal(err)
+	}
+	if busy := testutil.ToFloat64(c.busySessions.WithLabelValues("IMSA")); busy != 1 {
+		t.Errorf("%v busy sessions during the exchange, want 1", busy)
+	}
+	resp, err := sr.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = resp.Out(true)
+	return err
+}
+
+func TestSessions(t *testing.T) {
+	c := New()
+	sess := serve(t, c, output(csm))
+	active := c.activeSessions.WithLabelValues("IMSA")
+	busy := c.busySessions.WithLabelValues("IMSA")
+
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(active); n != 1 {
+		t.Errorf("%v active sessions after the connect, want 1", n)
+	}
+	if err := exchange(t, sess, c); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(busy); n != 0 {
+		t.Errorf("%v busy sessions after the exchange, want 0", n)
+	}
+	if err := sess.End(); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(active); n != 0 {
+		t.Errorf("%v active sessions after the disconnect, want 0", n)
+	}
+}
+
+func TestStatusCodes(t *testing.T) {
+	c := New()
+	sess := serve(t, c, output(rsm(4, 40)), output(rsm(4, 40)), output(rsm(8, 12)))
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sess.End()
+	for i := 0; i < 3; i++ {
+		if err := exchange(t, sess, c); err == nil {
+			t.Fatal("the IMS connect error isn't returned")
+		}
+	}
+
+	want := `
+# HELP imstm_rsm_total Request status messages returned by IMS connect, by return and reason code.
+# TYPE imstm_rsm_total counter
+imstm_rsm_total{datastore="IMSA",reason_code="12",return_code="8"} 1
+imstm_rsm_total{datastore="IMSA",reason_code="40",return_code="4"} 2
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want), "imstm_rsm_total"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.ToFloat64(c.busySessions.WithLabelValues("IMSA")); n != 0 {
+		t.Errorf("%v busy sessions after the failed exchanges, want 0", n)
+	}
+}
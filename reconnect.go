@@ -0,0 +1,195 @@
+package imstm
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrDisconnected indicates that the connection to IMS connect is lost and the session
+// is not reconnected
+var ErrDisconnected = errors.New("Session is disconnected")
+
+// ReconnectPolicy configures the automatic reconnect of a session.
+//
+// The connection is re-established only before a new request is written. The request or the
+// acknowledgement that failed with the lost connection is never replayed, its error is returned
+// to the caller, who decides whether it's safe to send again. A context in resume tpipe
+// re-issues the resume tpipe request on its next Recv() after the reconnect.
+type ReconnectPolicy struct {
+	// MaxAttempts is the maximum number of dial attempts per reconnect. Defaults to 5, a negative
+	// value means unlimited. The waits between the attempts end early with the error of the
+	// context.Context set by SetGoContext, once it's done
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the second attempt. Defaults to 100ms
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the wait between attempts. Defaults to 30s
+	MaxBackoff time.Duration
+
+	// Multiplier is the growth factor of the backoff between attempts. Defaults to 2
+	Multiplier float64
+
+	// Jitter is the fraction, between 0 and 1, of the backoff that is randomized
+	Jitter float64
+}
+
+// backoff returns the wait after the given failed attempt
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	wait, max, mult := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if wait <= 0 {
+		wait = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if mult < 1 {
+		mult = 2
+	}
+	for i := 1; i < attempt && wait < max; i++ {
+		wait = time.Duration(float64(wait) * mult)
+	}
+	if wait > max {
+		wait = max
+	}
+	if p.Jitter > 0 {
+		wait = wait - time.Duration(p.Jitter*rand.Float64()*float64(wait))
+	}
+	return wait
+}
+
+// lostConn returns the cause, if the exchange outcome implies a lost connection
+func lostConn(resp *Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp != nil {
+		if e, ok := resp.statusErr().(*IMSConnectError); ok && e.Disconnected() {
+			return e
+		}
+	}
+	return nil
+}
+
+// disconnect marks the connection as lost, terminating the current exchange
+func (s *Session) disconnect(cause error) {
+	s.mu.Lock()
+	if s.down {
+		s.mu.Unlock()
+		return
+	}
+	s.down = true
+	owner := s.owner
+	s.idle()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.unlock()
+	if owner != nil {
+		owner.abandon(cause)
+	}
+	s.emit(Event{Type: EventDisconnect, Err: cause})
+
+	//network errors eject the cluster endpoint, ims connect errors are judged by received
+	if _, ok := cause.(*IMSConnectError); !ok && s.ep != nil {
+		s.ep.cluster.eject(s.ep, cause)
+	}
+
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(cause)
+	}
+}
+
+// fail terminates the exchange of the context after a failed write. The message stream
+// can't be trusted after a partial write, hence the connection is treated as lost.
+func (s *Session) fail(ctx *Context, err error) {
+	s.disconnect(err)
+	s.release(ctx)
+}
+
+// connected makes sure that the session is connected, reconnecting if the connection
+// is lost and the reconnect policy is set
+func (s *Session) connected(gctx context.Context) error {
+	s.mu.Lock()
+	down, ended := s.downLocked(), s.ended
+	s.mu.Unlock()
+	if !down {
+		return nil
+	}
+	if ended || s.Reconnect == nil {
+		return ErrDisconnected
+	}
+	return s.reconnect(gctx)
+}
+
+// reconnect re-establishes the connection as per the reconnect policy. The dial lock is held
+// only for an attempt, so the waits of one caller don't hold up the others.
+func (s *Session) reconnect(gctx context.Context) error {
+	policy := s.Reconnect
+	max := policy.MaxAttempts
+	if max == 0 {
+		max = 5
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.redial(attempt)
+		if err == nil {
+			return nil
+		}
+		if max > 0 && attempt >= max {
+			return err
+		}
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-gctx.Done():
+			timer.Stop()
+			return gctx.Err()
+		}
+	}
+}
+
+// redial makes the dial attempt, unless the session is already reconnected by another goroutine
+func (s *Session) redial(attempt int) error {
+	s.dialMu.Lock()
+	defer s.dialMu.Unlock()
+	if !s.isDown() {
+		return nil
+	}
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.ended {
+		//the session is ended by the user while dialing
+		s.mu.Unlock()
+		conn.Close()
+		return ErrDisconnected
+	}
+	s.conn = conn
+	s.down = false
+	s.mu.Unlock()
+	s.emit(Event{Type: EventConnect})
+	s.emit(Event{Type: EventReconnect, Attempts: attempt})
+	if s.OnReconnect != nil {
+		s.OnReconnect(attempt)
+	}
+	return nil
+}
+
+// restore re-establishes the lost connection, unless the session is ended by the user.
+// Without a reconnect policy, a single attempt is made.
+func (s *Session) restore(gctx context.Context) error {
+	s.mu.Lock()
+	down, ended := s.downLocked(), s.ended
+	s.mu.Unlock()
+	if !down || ended {
+		return nil
+	}
+	if s.Reconnect != nil {
+		return s.reconnect(gctx)
+	}
+	return s.redial(1)
+}
@@ -0,0 +1,126 @@
+package imstm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+	var attempts int
+	sess.Reconnect = &ReconnectPolicy{InitialBackoff: time.Millisecond}
+	sess.OnReconnect = func(n int) { attempts = n }
+
+	sess.disconnect(errors.New("lost"))
+	sr := NewContext(sess).WithSendRecv(false, false, false)
+	if err := sr.Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sr.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := resp.Out(true); err != nil || string(out[0]) != "OUT" {
+		t.Fatal(out, err)
+	}
+	if attempts != 1 {
+		t.Fatalf("reconnected after %d attempts, want 1", attempts)
+	}
+}
+
+func TestReconnectBounded(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	sess := srv.session(t)
+	defer sess.End()
+	srv.Close()
+	sess.Reconnect = &ReconnectPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	//the default attempts are bounded
+	sess.disconnect(errors.New("lost"))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- NewContext(sess).WithSendRecv(false, false, false).Send(nil, false)
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("send on the closed server succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconnect is not bounded")
+	}
+
+	//unlimited attempts end with the go context
+	sess.Reconnect = &ReconnectPolicy{MaxAttempts: -1, InitialBackoff: time.Hour}
+	gctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := NewContext(sess).SetGoContext(gctx).WithSendRecv(false, false, false).Send(nil, false)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestReconnectEnded(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+	sess.Reconnect = &ReconnectPolicy{}
+	sess.disconnect(errors.New("lost"))
+
+	//the session ended while dialing stays ended
+	var conn net.Conn
+	sess.WrapConn = func(c net.Conn) net.Conn {
+		sess.End()
+		conn = c
+		return c
+	}
+	if err := sess.redial(1); err != ErrDisconnected {
+		t.Fatalf("got %v, want ErrDisconnected", err)
+	}
+	if !sess.isDown() {
+		t.Fatal("ended session is reconnected")
+	}
+	if _, err := conn.Write([]byte{0}); err == nil {
+		t.Fatal("connection of the ended session is open")
+	}
+}
+
+func TestReconnectResumeTpipe(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+	sess.Reconnect = &ReconnectPolicy{InitialBackoff: time.Millisecond}
+
+	rcv := NewContext(sess).WithRecvOnly(false, true, false)
+	for i := 0; i < 2; i++ {
+		resp, err := rcv.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := resp.Out(true); err != nil || string(out[0]) != "OUT" {
+			t.Fatal(out, err)
+		}
+		if err := rcv.Ack(); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			sess.disconnect(errors.New("lost"))
+		}
+	}
+	var resumes int
+	for _, req := range srv.awaitRequests(t, 4) {
+		if req[35] == IRMF4RESTPIPE {
+			resumes++
+		}
+	}
+	if resumes != 2 {
+		t.Fatalf("%d resume tpipe requests, want 2", resumes)
+	}
+}
@@ -0,0 +1,130 @@
+package imstm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Directions of the captured frames
+const (
+	DirRequest  = "request"  //frame written to IMS connect
+	DirResponse = "response" //frame read from IMS connect
+)
+
+// Frame is a request or a response message captured by a Recorder
+type Frame struct {
+	Time time.Time `json:"time"`
+	Conn int       `json:"conn"` //sequence of the connection in the capture
+	Dir  string    `json:"dir"`  //DirRequest or DirResponse
+	Data []byte    `json:"data"` //complete message including LLLL
+}
+
+// Recorder captures the IMS connect traffic of the wrapped connections into a capture file.
+// The capture file has a JSON encoded Frame per line. The credentials of the requests, like
+// the racf password and the OTMA security data, are always masked before the frames are
+// written. The responses are framed by their total length, hence only the traffic of the
+// length prefixed exits, like HWSSMPL1, can be recorded.
+//
+// A Recorder is set on the session using its WrapConn hook:
+//
+//	sess.WrapConn = ims.NewRecorder(file).Wrap
+type Recorder struct {
+	// Exit is the message exit of the recorded sessions, locating the credentials masked in
+	// the requests. Defaults to HWSSMPL1
+	Exit MessageExit
+
+	mu    sync.Mutex
+	enc   *json.Encoder
+	conns int
+	err   error
+}
+
+// NewRecorder returns a Recorder writing the capture to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Wrap returns the connection recording the traffic of conn
+func (rec *Recorder) Wrap(conn net.Conn) net.Conn {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.conns++
+	return &recordConn{Conn: conn, rec: rec, id: rec.conns}
+}
+
+// exit returns the message exit of the recorded sessions, HWSSMPL1 by default
+func (rec *Recorder) exit() MessageExit {
+	if rec.Exit != nil {
+		return rec.Exit
+	}
+	return HWSSMPL1
+}
+
+// Err returns the first error writing the capture
+func (rec *Recorder) Err() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.err
+}
+
+// record writes the frame to the capture
+func (rec *Recorder) record(f Frame) {
+	if f.Dir == DirRequest {
+		maskCredentials(rec.exit(), f.Data)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if err := rec.enc.Encode(f); err != nil && rec.err == nil {
+		rec.err = err
+	}
+}
+
+// recordConn is the connection recording its traffic
+type recordConn struct {
+	net.Conn
+	rec *Recorder
+	id  int
+
+	wmu, rmu sync.Mutex
+	wbuf     []byte //partial request written
+	rbuf     []byte //partial response read
+}
+
+// Write writes to the connection and records the complete requests
+func (c *recordConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = c.frames(append(c.wbuf, b[:n]...), DirRequest)
+	return n, err
+}
+
+// Read reads from the connection and records the complete responses
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.rbuf = c.frames(append(c.rbuf, b[:n]...), DirResponse)
+	return n, err
+}
+
+// frames records the complete frames in buf and returns the remaining partial frame
+func (c *recordConn) frames(buf []byte, dir string) []byte {
+	for len(buf) >= 4 {
+		n := int(binary.BigEndian.Uint32(buf[:4]))
+		if n < 4 || len(buf) < n {
+			break
+		}
+		data := append([]byte(nil), buf[:n]...)
+		c.rec.record(Frame{Time: time.Now(), Conn: c.id, Dir: dir, Data: data})
+		buf = buf[n:]
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	return buf
+}
@@ -0,0 +1,236 @@
+package imstm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+)
+
+// Matcher matches the data segments of a recorded request with an incoming request,
+// in addition to the message type and the transaction code
+type Matcher func(recorded, incoming [][]byte) bool
+
+// LoadCapture reads the frames of a capture written by a Recorder
+func LoadCapture(r io.Reader) ([]Frame, error) {
+	var frames []Frame
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var f Frame
+		if err := dec.Decode(&f); err == io.EOF {
+			return frames, nil
+		} else if err != nil {
+			return frames, err
+		}
+		frames = append(frames, f)
+	}
+}
+
+// replayExchange is a recorded request with its responses
+type replayExchange struct {
+	request   []byte
+	responses [][]byte
+	used      bool
+}
+
+// ReplayServer serves the recorded responses to the requests matching the recorded requests.
+// A request matches, if the message type, the transaction code and all the Matchers match.
+// The recorded exchanges are served in the recorded order, the last match is served again
+// once all the matches are used. The connection is closed on a request that doesn't match.
+type ReplayServer struct {
+	Frames   []Frame
+	Matchers []Matcher
+
+	// Exit is the message exit of the recorded sessions, locating the segments of the requests
+	// after the IRM header and the prefixes. Defaults to HWSSMPL1
+	Exit MessageExit
+
+	mu        sync.Mutex
+	once      sync.Once
+	exchanges []*replayExchange
+	ln        net.Listener
+}
+
+// Start starts serving on the tcp address, like "127.0.0.1:0"
+func (s *ReplayServer) Start(addr string) error {
+	s.once.Do(s.load)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	go s.serve(ln)
+	return nil
+}
+
+// Addr returns the address the server is listening on
+func (s *ReplayServer) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return ""
+	}
+	return s.ln.Addr().String()
+}
+
+// Close stops the server
+func (s *ReplayServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+// load pairs the recorded requests with the responses following them on their connection
+func (s *ReplayServer) load() {
+	last := make(map[int]*replayExchange)
+	for _, f := range s.Frames {
+		switch f.Dir {
+		case DirRequest:
+			ex := &replayExchange{request: f.Data}
+			s.exchanges = append(s.exchanges, ex)
+			last[f.Conn] = ex
+		case DirResponse:
+			if ex := last[f.Conn]; ex != nil {
+				ex.responses = append(ex.responses, f.Data)
+			}
+		}
+	}
+}
+
+// serve accepts the connections till the listener is closed
+func (s *ReplayServer) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle serves the requests of a connection
+func (s *ReplayServer) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(length[:])
+		if n < 4 {
+			return
+		}
+		req := make([]byte, n)
+		copy(req, length[:])
+		if _, err := io.ReadFull(conn, req[4:]); err != nil {
+			return
+		}
+		ex := s.match(req)
+		if ex == nil {
+			return
+		}
+		for _, resp := range ex.responses {
+			if _, err := conn.Write(resp); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// exit returns the message exit of the recorded sessions, HWSSMPL1 by default
+func (s *ReplayServer) exit() MessageExit {
+	if s.Exit != nil {
+		return s.Exit
+	}
+	return HWSSMPL1
+}
+
+// match returns the recorded exchange matching the request
+func (s *ReplayServer) match(req []byte) *replayExchange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var last *replayExchange
+	for _, ex := range s.exchanges {
+		if !s.matches(ex.request, req) {
+			continue
+		}
+		if !ex.used {
+			ex.used = true
+			return ex
+		}
+		last = ex
+	}
+	return last
+}
+
+// matches tells if the incoming request matches the recorded request
+func (s *ReplayServer) matches(recorded, incoming []byte) bool {
+	if msgType(recorded) != msgType(incoming) ||
+		!bytes.Equal(tranCodeKey(s.exit(), recorded), tranCodeKey(s.exit(), incoming)) {
+		return false
+	}
+	rsegs, isegs := frameSegments(s.exit(), recorded), frameSegments(s.exit(), incoming)
+	for _, m := range s.Matchers {
+		if !m(rsegs, isegs) {
+			return false
+		}
+	}
+	return true
+}
+
+// msgType returns the IRM F4 message type of the request
+func msgType(req []byte) byte {
+	if len(req) < 36 {
+		return 0
+	}
+	return req[35]
+}
+
+// tranCodeKey returns the transaction code of the request, from the IRM header or
+// the first 8 bytes of the message
+func tranCodeKey(exit MessageExit, req []byte) []byte {
+	if len(req) >= 44 {
+		if tran := bytes.TrimRight(req[36:44], "\x00\x40"); len(tran) > 0 {
+			return tran
+		}
+	}
+	segs := frameSegments(exit, req)
+	if len(segs) == 0 {
+		return nil
+	}
+	tran := segs[0]
+	if len(tran) > 8 {
+		tran = tran[:8]
+	}
+	if i := bytes.IndexByte(tran, '\x40'); i >= 0 {
+		tran = tran[:i]
+	}
+	return tran
+}
+
+// frameSegments returns the data of the segments of the request, excluding LLZZ. The segments
+// follow the IRM header, including its extensions, and the prefixes located by the exit.
+func frameSegments(exit MessageExit, req []byte) [][]byte {
+	off := segmentsOffset(exit, req)
+	if off < 0 {
+		return nil
+	}
+	var segs [][]byte
+	for off+4 <= len(req) {
+		ll := int(binary.BigEndian.Uint16(req[off : off+2]))
+		if ll <= 4 || off+ll > len(req) { //trailer or malformed
+			break
+		}
+		segs = append(segs, req[off+4:off+ll])
+		off += ll
+	}
+	return segs
+}
@@ -0,0 +1,108 @@
+package imstm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// equalSegments matches the recorded and the incoming segments byte for byte
+func equalSegments(recorded, incoming [][]byte) bool {
+	if len(recorded) != len(incoming) {
+		return false
+	}
+	for i := range recorded {
+		if !bytes.Equal(recorded[i], incoming[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// exchangeOut sends the input on the send receiver and returns the output
+func exchangeOut(t *testing.T, sr SendReceiver, in string) string {
+	if err := sr.Send([][]byte{[]byte(in)}, true); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sr.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := resp.Out(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return string(out[0])
+}
+
+func TestRecordReplay(t *testing.T) {
+	srv := newFakeServer(t, func(req []byte) []byte {
+		if req[35] != IRMF4SENDRECV {
+			return nil
+		}
+		//the output tells the input apart, regardless of the prefixes
+		segs := frameSegments(HWSSMPL1, req)
+		if len(segs) == 0 {
+			return frame(csmSeg(0, 0))
+		}
+		return frame(seg(append(A2E([]byte("OUT ")), segs[0]...)), csmSeg(0, 0))
+	})
+	defer srv.Close()
+
+	//record
+	var capture bytes.Buffer
+	rec := NewRecorder(&capture)
+	sess := &Session{Addr: srv.l.Addr().String(), WrapConn: rec.Wrap}
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	headers := OTMAHeaders{Architecture: 1, Userid: "OTMAUSER", UserData: []byte("ROUTING")}
+	ctx := NewContext(sess).SetTranCode("TRAN")
+	ctx.SetExtensions(&RawIRMExtension{ID: "*TEST*", Data: []byte("EXTENSION")})
+	want := []string{
+		exchangeOut(t, ctx.WithSendRecv(false, false, false), "ONE"),
+		exchangeOut(t, ctx.WithOTMA(headers), "TWO"),
+	}
+	sess.End()
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want[0] != "OUT ONE" || want[1] != "OUT TWO" {
+		t.Fatalf("recorded %q", want)
+	}
+
+	//replay
+	frames, err := LoadCapture(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 4 {
+		t.Fatalf("%d frames captured, want 4", len(frames))
+	}
+	for i, in := range []string{"ONE", "TWO"} {
+		segs := frameSegments(HWSSMPL1, frames[2*i].Data)
+		if len(segs) != 1 || string(E2A(segs[0])) != in {
+			t.Fatalf("segments of the request %d are %q, want %s", i, segs, in)
+		}
+	}
+	replay := &ReplayServer{Frames: frames, Matchers: []Matcher{equalSegments}}
+	if err := replay.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	sess = &Session{Addr: replay.Addr()}
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sess.End()
+	ctx = NewContext(sess).SetTranCode("TRAN")
+	ctx.SetExtensions(&RawIRMExtension{ID: "*TEST*", Data: []byte("EXTENSION")})
+	if got := exchangeOut(t, ctx.WithOTMA(headers), "TWO"); got != want[1] {
+		t.Errorf("replayed %q, want %q", got, want[1])
+	}
+	if got := exchangeOut(t, ctx.WithSendRecv(false, false, false), "ONE"); got != want[0] {
+		t.Errorf("replayed %q, want %q", got, want[0])
+	}
+}
@@ -3,7 +3,6 @@ package imstm
 import (
 	"encoding/binary"
 	"io"
-	"net"
 	"time"
 )
 
@@ -14,6 +13,9 @@ type Request struct {
 	timeout   time.Duration //timeout in ms to fetch each segment
 	irmHeader *IRMHeader    //irm header for the request, owned by request
 	segments  [][]byte      //message segments, owned by request
+	header    []byte        //irm header encoded by the message exit
+	trailer   []byte        //end of the request as per the message exit
+	err       error         //error encoding the irm header
 }
 
 const maxSegLen = 32 * 1024
@@ -37,35 +39,81 @@ func (r *Request) AddSegment(segment []byte) *Request {
 	return r
 }
 
-// Write writes the request message on to the network connection writer interface
+// writeDeadliner is implemented by writers supporting write deadlines, like net.Conn
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// Write writes the request message on to the network connection writer interface.
+// A zero timeout doesn't set any write deadline.
 func (r *Request) Write() error {
-	defer r.writer.(net.Conn).SetWriteDeadline(time.Now().Add(0 * time.Second))
-	header, _ := r.irmHeader.MarshalBinary()
+	if r.err != nil {
+		return r.err
+	}
+	header := append([]byte(nil), r.header...)
 	//populate the total length
 	binary.BigEndian.PutUint32(header[:4], r.length)
-	r.writer.(net.Conn).SetWriteDeadline(time.Now().Add(r.timeout))
-	//TODO: handle errors and incomplete writes, although not an issue for sockets
-	//write the header
-	if _, err := r.writer.Write(header); err != nil {
-		return err
+	if d, ok := r.writer.(writeDeadliner); ok && r.timeout > 0 {
+		defer d.SetWriteDeadline(time.Time{})
+		d.SetWriteDeadline(time.Now().Add(r.timeout))
 	}
-	for _, seg := range r.segments {
-		if _, err := r.writer.Write(seg); err != nil {
-			return err
+	//write the header, segments and the trailer, tracking the bytes written
+	var written int
+	for _, buf := range append(append([][]byte{header}, r.segments...), r.trailer) {
+		if len(buf) == 0 {
+			continue
+		}
+		n, err := r.writer.Write(buf)
+		written += n
+		if err != nil {
+			return &WriteError{Written: written, Err: err}
 		}
 	}
-	_, err := r.writer.Write(RequestTrailer)
-	return err
+	return nil
+}
+
+// WriteError is returned when writing the request fails. Written tells if any part of the
+// request has left the client, in which case it may have reached IMS.
+type WriteError struct {
+	Written int   //number of bytes written before the failure
+	Err     error //underlying write error
+}
+
+// Error returns the underlying write error
+func (e *WriteError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying write error
+func (e *WriteError) Unwrap() error {
+	return e.Err
 }
 
 // NewRequest function creates a new requtest with the supplied IRM header and write timeout
 // parameters. The request message is automatically constructed when the users invoke the
-// corresponding Context's Send() method
+// corresponding Context's Send() method. The architecture and the length of the IRM header
+// are normalized as per the fields in use. The request is laid out for the HWSSMPL1 exit.
 func NewRequest(writer io.Writer, irmHeader IRMHeader, timeout time.Duration) *Request {
+	return newRequest(writer, irmHeader, timeout, HWSSMPL1)
+}
+
+// newRequest creates a new request laid out for the message exit
+func newRequest(writer io.Writer, irmHeader IRMHeader, timeout time.Duration, exit MessageExit) *Request {
 	var r Request
-	r.irmHeader = &irmHeader
+	r.irmHeader = irmHeader.Normalize()
 	r.writer = writer
 	r.timeout = timeout
-	r.length = 4 + uint32(binary.BigEndian.Uint16(r.irmHeader.Length[:])) + 4
+	r.header, r.err = exit.MarshalIRM(r.irmHeader)
+	r.trailer = exit.Trailer()
+	r.length = uint32(len(r.header) + len(r.trailer))
 	return &r
 }
+
+// addPrefix appends the prefix, like the client built otma headers, to the irm header
+func (r *Request) addPrefix(prefix []byte) {
+	if r.err != nil || len(prefix) == 0 {
+		return
+	}
+	r.header = append(r.header, prefix...)
+	r.length = r.length + uint32(len(prefix))
+}
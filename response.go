@@ -3,9 +3,9 @@ package imstm
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
-	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,6 +15,9 @@ var ErrInvalidUnmarshal = errors.New("Invalid Unmarshal Object")
 // ErrSegmentNotPresent indicates the requested segment not present in the response message
 var ErrSegmentNotPresent = errors.New("Segment not present")
 
+// ErrInvalidSegment indicates a segment with invalid length in the response message
+var ErrInvalidSegment = errors.New("Invalid segment length")
+
 // RespRMM represents Request Mod Message in the response
 type RespRMM struct {
 	LL  [2]byte
@@ -134,6 +137,7 @@ type Response struct {
 	reader  io.Reader     //reader stored here
 	timeout time.Duration //timeout in ms to fetch each segment
 	initial bool          //at the start of the message?
+	done    bool          //complete message is read
 	retCode uint32        //ims connect return code
 	rsnCode uint32        //ims connect reason code
 	rmm     []byte        //request mod message
@@ -142,6 +146,28 @@ type Response struct {
 	rsm     []byte        //request status message, marks error
 	cortok  []byte        //correlation token for sync callouts
 	data    [][]byte      //data segments
+
+	//bookkeeping for the response status
+	ackExpected bool      //ack or nak is expected by the protocol for the output
+	cm0         bool      //request is sent in commit-then-send mode
+	async       bool      //output is retrieved using resume tpipe
+	flow        bool      //resume tpipe continues to flow messages after acknowledgement
+	acked       bool      //output is already acknowledged
+	syncpt      bool      //output is sent with sync level SYNCPT
+	conv        bool      //output belongs to an IMS conversation
+	dfs2082     bool      //DFS2082 is requested for the CM0 output
+	start       time.Time //time at which the response is awaited from
+	firstByte   time.Time //time at which the first byte is received
+	totBytes    int       //total bytes read
+	dataSegs    int       //number of data segments read
+
+	onDone   func(*Response, error) //invoked once the message is completely read or failed
+	ended    bool                   //message is completely read or failed
+	endErr   error                  //read failure that ended the message
+	codePage CodePage               //code page for the ascii conversion, defaults to CP037
+
+	dump     func(*Response, RespSegType, []byte) //logs the wire dump of the segments
+	unframed bool                                 //output is not prefixed by the total length
 }
 
 // RespSegType is the type of segment in the IMS connect response
@@ -158,6 +184,19 @@ const (
 	RESPSEGCSM  RespSegType = 'S'    //Status CSM segment - *CSMOKY*
 )
 
+// readDeadliner is implemented by readers supporting read deadlines, like net.Conn
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// segBufPool holds the reusable segment buffers for pooled segment iteration
+var segBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, maxSegLen)
+		return &buf
+	},
+}
+
 // ReadNextSegment fetches the next segment.
 // Internally a net.Conn read call is issued to fetch the next segment of the message.
 // It retursn the type of the segment, data of the segment and an error.
@@ -171,15 +210,22 @@ const (
 // IMS connect response, RESPSEGCSM - which contains Complete Status Message indicating successful
 // response.
 func (r *Response) ReadNextSegment() (segType RespSegType, segData []byte, err error) {
+	return r.readSegment(nil)
+}
+
+// readSegment reads the next segment into buf, growing it if the capacity is not sufficient.
+// The status segments are retained by the response, as buf may be reused by the caller
+func (r *Response) readSegment(buf []byte) (segType RespSegType, segData []byte, err error) {
 
 	segType = RESPSEGINV
 	//reset the read timeout at the once the complete message is read
 	defer func() {
 		switch segType {
 		case RESPSEGINV:
-		case RESPSEGERR:
-		case RESPSEGCSM:
-			r.reader.(net.Conn).SetReadDeadline(time.Now().Add(0 * time.Second))
+		case RESPSEGERR, RESPSEGCSM:
+			if d, ok := r.reader.(readDeadliner); ok {
+				d.SetReadDeadline(time.Time{})
+			}
 		}
 	}()
 
@@ -189,98 +235,182 @@ func (r *Response) ReadNextSegment() (segType RespSegType, segData []byte, err e
 	//get the total length
 	if r.initial {
 		r.initial = false
-		r.reader.(net.Conn).SetReadDeadline(time.Now().Add(r.timeout))
-		if _, err = io.ReadFull(r.reader, length[:]); err != nil {
-			goto badExit
+		if d, ok := r.reader.(readDeadliner); ok && r.timeout > 0 {
+			d.SetReadDeadline(time.Now().Add(r.timeout))
+		}
+		if !r.unframed {
+			if _, err = io.ReadFull(r.reader, length[:1]); err != nil {
+				goto badExit
+			}
+			r.firstByte = time.Now()
+			if _, err = io.ReadFull(r.reader, length[1:]); err != nil {
+				goto badExit
+			}
+			r.length = binary.BigEndian.Uint32(length[:4])
+			r.totBytes += 4
 		}
-		r.length = binary.BigEndian.Uint32(length[:4])
 	}
 
 	// read each segment
 	if _, err = io.ReadFull(r.reader, length[:2]); err != nil {
 		goto badExit
 	}
-	//TODO: n can't be less than 2
+	if r.firstByte.IsZero() {
+		r.firstByte = time.Now()
+	}
 	segLen = binary.BigEndian.Uint16(length[:2])
-	segData = make([]byte, int(segLen))
+	if segLen < 4 {
+		err = ErrInvalidSegment
+		goto badExit
+	}
+	if cap(buf) < int(segLen) {
+		buf = make([]byte, int(segLen))
+	}
+	segData = buf[:segLen]
 	copy(segData[:2], length[:2])
 	if _, err = io.ReadFull(r.reader, segData[2:]); err != nil {
+		segData = nil
 		goto badExit
 	}
 
+	r.totBytes += int(segLen)
+
 	segType = RESPSEGDATA
 	if segLen >= 12 {
 		switch string(E2A(segData[4:12])) {
 		case "*REQSTS*":
 			segType = RESPSEGERR
-			break
 		case "*REQMOD*":
-			segType = RESPSEGERR
-			break
+			segType = RESPSEGRMM
 		case "*GENCID*":
 			segType = RESPSEGCID
-			break
 		case "*CSMOKY*":
 			segType = RESPSEGCSM
-			break
-		case "*CORTOKN":
+		case "*CORTKN*":
 			segType = RESPSEGCT
-			break
 		}
 	}
+	if r.dump != nil {
+		r.dump(r, segType, segData)
+	}
+	r.record(segType, segData)
 	goto goodExit
 badExit:
 	//TODO: wrap the errors in future
+	r.complete(err)
 goodExit:
 	return segType, segData, err
 }
 
+// record retains a copy of the status segments and marks the end of the message
+func (r *Response) record(segType RespSegType, segData []byte) {
+	switch segType {
+	case RESPSEGERR:
+		r.rsm = append([]byte(nil), segData...)
+		var rsm RespRSM
+		(&rsm).UnmarshalBinary(r.rsm)
+		r.retCode = binary.BigEndian.Uint32(rsm.RetCode[:])
+		r.rsnCode = binary.BigEndian.Uint32(rsm.RsnCode[:])
+		r.done = true
+		r.complete(nil)
+	case RESPSEGCT:
+		r.cortok = append([]byte(nil), segData...)
+	case RESPSEGRMM:
+		r.rmm = append([]byte(nil), segData...)
+	case RESPSEGCID:
+		r.cid = append([]byte(nil), segData...)
+	case RESPSEGCSM:
+		r.csm = append([]byte(nil), segData...)
+		r.done = true
+		r.complete(nil)
+	case RESPSEGDATA:
+		r.dataSegs++
+	}
+}
+
+// complete invokes the completion hook once
+func (r *Response) complete(err error) {
+	if r.ended {
+		return
+	}
+	r.ended, r.endErr = true, err
+	if fn := r.onDone; fn != nil {
+		r.onDone = nil
+		fn(r, err)
+	}
+}
+
+// OnComplete registers fn to be invoked once the message is completely read, or its read fails.
+// err is the read failure, or the IMS connect error reported in the RSM segment.
+// If the message is already complete, fn is invoked immediately.
+func (r *Response) OnComplete(fn func(r *Response, err error)) {
+	hook := func(r *Response, err error) {
+		if err == nil {
+			err = r.statusErr()
+		}
+		fn(r, err)
+	}
+	if r.ended {
+		hook(r, r.endErr)
+		return
+	}
+	prev := r.onDone
+	r.onDone = func(r *Response, err error) {
+		if prev != nil {
+			prev(r, err)
+		}
+		hook(r, err)
+	}
+}
+
 // readAllSegments reads all the segments in the output message at once
 func (r *Response) readAllSegments() error {
-	var end bool
-	for {
+	for !r.done {
 		segType, segData, err := r.ReadNextSegment()
 		if err != nil {
 			return err
 		}
-		switch segType {
-		case RESPSEGERR:
-			r.rsm = segData
-			var rsm RespRSM
-			(&rsm).UnmarshalBinary(r.rsm)
-			r.retCode = binary.BigEndian.Uint32(rsm.RetCode[:])
-			r.rsnCode = binary.BigEndian.Uint32(rsm.RsnCode[:])
-			end = true
-			break
-		case RESPSEGCT:
-			r.cortok = segData
-			break
-		case RESPSEGRMM:
-			r.rmm = segData
-			break
-		case RESPSEGCID:
-			r.cid = segData
-			break
-		case RESPSEGDATA:
+		if segType == RESPSEGDATA {
 			r.data = append(r.data, segData)
-			break
-		case RESPSEGCSM:
-			r.csm = segData
-			end = true
-			break
 		}
-		if end {
-			return nil
+	}
+	return nil
+}
+
+// statusErr returns the IMS connect error reported in the RSM segment, if any
+func (r *Response) statusErr() error {
+	if r.rsm != nil {
+		return &IMSConnectError{
+			ReturnCode: ReturnCode(r.retCode),
+			ReasonCode: ReasonCode(r.rsnCode),
+			RacfRc:     r.rsm[3],
 		}
 	}
+	return nil
+}
+
+// dfs2082Err returns the DFS2082 message as an error, if the output is the DFS2082 message
+// requested for the transactions not replying on the IOPCB
+func (r *Response) dfs2082Err() error {
+	if !r.dfs2082 || len(r.data) == 0 {
+		return nil
+	}
+	text := string(r.decode(r.data[0][4:]))
+	if !strings.HasPrefix(text, "DFS2082") {
+		return nil
+	}
+	return &DFS2082Error{Text: strings.TrimRight(text, " \x00")}
 }
 
 // Out will return the complete response message from IMS.
 // Passing ascii parameter as true converts each byte slice into ascii from ebcidic.
-// This may not be useful when your response message is not completely text data.
+// When ascii is false, the raw segment data without the LLZZ is returned.
 //
 // Error can represent the network errors, io read errors and more important the
 // IMS connect return and reason codes present in the RSM segment, like security violations etc.
+//
+// Out reads the message only once and can be invoked repeatedly, but the data segments
+// already consumed by a SegmentIterator are not available to Out.
 func (r *Response) Out(ascii bool) ([][]byte, error) {
 	var err error
 	//read all the segments of the message
@@ -289,8 +419,10 @@ func (r *Response) Out(ascii bool) ([][]byte, error) {
 	}
 
 	//if error segment present, nothing else can exist
-	if r.rsm != nil {
-		err = fmt.Errorf("ErrIMSConnect: ReturnCode: %d, ReasonCode: %d", r.retCode, r.rsnCode)
+	if err = r.statusErr(); err != nil {
+		return nil, err
+	}
+	if err = r.dfs2082Err(); err != nil {
 		return nil, err
 	}
 	var out [][]byte
@@ -303,10 +435,11 @@ func (r *Response) Out(ascii bool) ([][]byte, error) {
 		//loop over the data
 		for _, seg := range r.data {
 			if ascii {
-				out = append(out, E2A(seg[4:]))
+				out = append(out, r.decode(seg[4:]))
 			} else {
 				segCopy := make([]byte, len(seg)-4)
-				out = append(out, segCopy[4:])
+				copy(segCopy, seg[4:])
+				out = append(out, segCopy)
 			}
 		}
 		return out, nil
@@ -314,6 +447,133 @@ func (r *Response) Out(ascii bool) ([][]byte, error) {
 	return nil, ErrSegmentNotPresent
 }
 
+// decode converts the ebcdic data to ascii using the code page of the response
+func (r *Response) decode(data []byte) []byte {
+	if r.codePage == nil {
+		return E2A(data)
+	}
+	return r.codePage.Decode(data)
+}
+
+// Segment represents a single segment of the IMS connect response message.
+// Raw and Data are views on the read buffer and are not copied.
+type Segment struct {
+	Type RespSegType //type of the segment
+	LL   uint16      //length of the segment including LLZZ
+	ZZ   [2]byte     //ZZ field, holds the flags for the status segments
+	Raw  []byte      //complete segment including LLZZ
+	Data []byte      //segment data excluding LLZZ
+
+	codePage CodePage //code page of the response
+}
+
+// ASCII returns a copy of the segment data converted from ebcdic to ascii, using the code page
+// set on the context by SetCodePage
+func (seg Segment) ASCII() []byte {
+	if seg.codePage == nil {
+		return E2A(seg.Data)
+	}
+	return seg.codePage.Decode(seg.Data)
+}
+
+// SegmentIterator reads the segments of a response one at a time from the connection.
+// It's typically used as follows:
+//
+//	it := resp.Segments()
+//	for it.Next() {
+//		seg := it.Segment()
+//		//process seg.Data
+//	}
+//	if err := it.Err(); err != nil {
+//		//handle error
+//	}
+//
+// The iteration ends after the CSM or RSM segment, both of which are yielded to the caller.
+type SegmentIterator struct {
+	resp   *Response
+	pooled bool    //reuse a single pooled buffer for all the segments
+	buf    *[]byte //pooled buffer
+	seg    Segment //current segment
+	err    error   //first error encountered
+	end    bool    //iteration ended
+}
+
+// Segments returns an iterator over the segments of the response.
+// Each segment is read into its own buffer, so the segment data remains valid after
+// subsequent calls to Next.
+func (r *Response) Segments() *SegmentIterator {
+	return &SegmentIterator{resp: r}
+}
+
+// PooledSegments returns an iterator over the segments of the response which reuses
+// a pooled read buffer. The segment data is only valid till the next call to Next, and
+// Release must be invoked once the iteration is done to return the buffer to the pool.
+func (r *Response) PooledSegments() *SegmentIterator {
+	return &SegmentIterator{resp: r, pooled: true}
+}
+
+// Next reads the next segment of the response. It returns false when the message is
+// completely read or an error occurs.
+func (it *SegmentIterator) Next() bool {
+	if it.end || it.err != nil {
+		return false
+	}
+	if it.resp.done {
+		it.end = true
+		it.err = it.resp.statusErr()
+		it.seg = Segment{}
+		return false
+	}
+	var buf []byte
+	if it.pooled {
+		if it.buf == nil {
+			it.buf = segBufPool.Get().(*[]byte)
+		}
+		buf = *it.buf
+	}
+	segType, segData, err := it.resp.readSegment(buf)
+	if err != nil {
+		it.err = err
+		it.seg = Segment{}
+		return false
+	}
+	if it.pooled && cap(segData) > cap(buf) {
+		*it.buf = segData[:0] //keep the grown buffer
+	}
+	it.seg = Segment{
+		Type: segType,
+		LL:   binary.BigEndian.Uint16(segData[:2]),
+		Raw:  segData,
+		Data: segData[4:],
+
+		codePage: it.resp.codePage,
+	}
+	copy(it.seg.ZZ[:], segData[2:4])
+	return true
+}
+
+// Segment returns the current segment
+func (it *SegmentIterator) Segment() Segment {
+	return it.seg
+}
+
+// Err returns the error encountered during the iteration. Besides the read errors,
+// it also returns the IMS connect error reported in the RSM segment.
+func (it *SegmentIterator) Err() error {
+	return it.err
+}
+
+// Release returns the pooled buffer, if any, back to the pool.
+// Segment data must not be used after the release.
+func (it *SegmentIterator) Release() {
+	if it.buf != nil {
+		*it.buf = (*it.buf)[:0]
+		segBufPool.Put(it.buf)
+		it.buf = nil
+	}
+	it.seg = Segment{}
+}
+
 // ModName returns the modname from the IOPCB ISRT call
 func (r *Response) ModName() (string, error) {
 	if r.rmm == nil {
@@ -342,5 +602,6 @@ func NewResponse(reader io.Reader, timeout time.Duration) *Response {
 	r.initial = true
 	r.timeout = timeout
 	r.reader = reader
+	r.start = time.Now()
 	return &r
 }
@@ -0,0 +1,101 @@
+package imstm
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// lowerCP decodes to lower case, to tell the code page of the response apart from CP037
+type lowerCP struct{}
+
+func (lowerCP) Encode(ascii []byte) []byte  { return A2E(ascii) }
+func (lowerCP) Decode(ebcdic []byte) []byte { return bytes.ToLower(E2A(ebcdic)) }
+
+func TestSegmentIterator(t *testing.T) {
+	msg := frame(seg(A2E([]byte("ONE"))), seg([]byte{0x00, 0xFF, 0x10}), csmSeg(0x20, 0))
+	resp := NewResponse(bytes.NewReader(msg), 0)
+	resp.codePage = lowerCP{}
+
+	var segs []Segment
+	it := resp.Segments()
+	for it.Next() {
+		segs = append(segs, it.Segment())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 3 {
+		t.Fatalf("%d segments, want 3", len(segs))
+	}
+	if segs[0].Type != RESPSEGDATA || segs[0].LL != 7 || string(segs[0].ASCII()) != "one" {
+		t.Errorf("first segment is %+v, %q", segs[0], segs[0].ASCII())
+	}
+	//binary data is available as is, and stays valid after the iteration
+	if !bytes.Equal(segs[1].Data, []byte{0x00, 0xFF, 0x10}) || !bytes.Equal(segs[1].Raw[:2], []byte{0, 7}) {
+		t.Errorf("binary segment is %X", segs[1].Raw)
+	}
+	if segs[2].Type != RESPSEGCSM || segs[2].ZZ != [2]byte{0x20, 0} {
+		t.Errorf("status segment is %+v", segs[2])
+	}
+	if it.Next() {
+		t.Error("iteration continues after the CSM")
+	}
+}
+
+func TestSegmentIteratorErr(t *testing.T) {
+	//the RSM segment is yielded, and its error is returned by Err
+	resp := NewResponse(bytes.NewReader(frame(rsmSeg(8, 40))), 0)
+	it := resp.Segments()
+	if !it.Next() || it.Segment().Type != RESPSEGERR {
+		t.Fatal("RSM segment is not yielded")
+	}
+	if it.Next() {
+		t.Fatal("iteration continues after the RSM")
+	}
+	if e, ok := it.Err().(*IMSConnectError); !ok || e.ReturnCode != 8 || e.ReasonCode != 40 {
+		t.Fatalf("got %v, want the RSM error", it.Err())
+	}
+
+	//a truncated message fails the read
+	msg := frame(seg(A2E([]byte("ONE"))), csmSeg(0, 0))
+	it = NewResponse(bytes.NewReader(msg[:len(msg)-3]), 0).Segments()
+	for it.Next() {
+	}
+	if it.Err() != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", it.Err())
+	}
+
+	//a segment shorter than LLZZ is invalid
+	it = NewResponse(bytes.NewReader([]byte{0, 0, 0, 6, 0, 2}), 0).Segments()
+	if it.Next() || it.Err() != ErrInvalidSegment {
+		t.Fatalf("got %v, want ErrInvalidSegment", it.Err())
+	}
+}
+
+func TestPooledSegments(t *testing.T) {
+	msg := frame(seg(A2E([]byte("FIRST"))), seg(A2E([]byte("SECOND"))), csmSeg(0, 0))
+	it := NewResponse(bytes.NewReader(msg), 0).PooledSegments()
+	var datas [][]byte
+	for it.Next() {
+		datas = append(datas, it.Segment().Data)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	//every segment is read into the same buffer
+	if &datas[0][0] != &datas[1][0] {
+		t.Error("segments are not read into the pooled buffer")
+	}
+	it.Release()
+	if seg := it.Segment(); seg.Raw != nil {
+		t.Error("segment survives the release")
+	}
+
+	//the released buffer is reused by the next iteration
+	it = NewResponse(bytes.NewReader(msg), 0).PooledSegments()
+	defer it.Release()
+	if !it.Next() || string(E2A(it.Segment().Data)) != "FIRST" {
+		t.Fatalf("got %q after the reuse", E2A(it.Segment().Data))
+	}
+}
@@ -0,0 +1,234 @@
+package imstm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Attempt records a single attempt of a retried exchange
+type Attempt struct {
+	Start    time.Time     //start of the attempt
+	Duration time.Duration //duration of the attempt
+	Err      error         //error of the attempt, nil for the successful attempt
+}
+
+// RetryError is returned by the retried exchanges, when they eventually fail.
+// It carries the history of all the attempts.
+type RetryError struct {
+	Attempts []Attempt //history of the attempts
+	Err      error     //error of the last attempt
+}
+
+// Error returns the error of the last attempt along with the number of attempts
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%v (after %d attempts)", e.Err, len(e.Attempts))
+}
+
+// Unwrap returns the error of the last attempt
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// RetryPolicy retries the send-receive exchanges on the transient errors:
+//
+// - connection failures before any byte of the request is written
+//
+// - datastore unavailable, i.e. return code 44 or reason codes 72 and 74 with any return code
+// but 16
+//
+// - IMS connect in shutdown, i.e. reason code 73 with any return code but 16
+//
+// Any other failure after the request is written may have reached OTMA, and such exchanges
+// are retried only when the context is marked idempotent using Context.SetIdempotent.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts including the first one. Defaults to 3
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry, doubled for every subsequent retry.
+	// Defaults to 100ms
+	Backoff time.Duration
+
+	// MaxBackoff caps the wait between the retries. Defaults to 5s. The wait ends early, without
+	// a retry, once the context.Context set by SetGoContext is done
+	MaxBackoff time.Duration
+}
+
+// contexter is implemented by the protocol types to expose their context
+type contexter interface {
+	context() *Context
+}
+
+func (s *ctxSendRecv) context() *Context { return s.ctx }
+func (s *ctxSendOnly) context() *Context { return s.ctx }
+func (r *ctxRecvOnly) context() *Context { return r.ctx }
+
+// Wrap returns a SendReceiver that retries the exchanges of sr as per the policy.
+// sr must be returned by a Context, like WithSendRecv(..).
+//
+// The Recv() of the returned SendReceiver reads the response completely before returning,
+// so that the IMS connect errors can be retried. Out() of such a response returns the
+// already read output.
+func (p *RetryPolicy) Wrap(sr SendReceiver) SendReceiver {
+	rsr := &retrySendRecv{policy: p, sr: sr}
+	if c, ok := sr.(contexter); ok {
+		rsr.ctx = c.context()
+	}
+	return rsr
+}
+
+// retrySendRecv is the SendReceiver retrying the exchanges
+type retrySendRecv struct {
+	policy   *RetryPolicy
+	sr       SendReceiver
+	ctx      *Context
+	segments [][]byte  //segments of the current exchange
+	ascii    bool      //ascii conversion of the current exchange
+	attempts []Attempt //attempts of the current exchange
+}
+
+func (r *retrySendRecv) context() *Context { return r.ctx }
+
+// Send sends the message, retrying the transient failures
+func (r *retrySendRecv) Send(segments [][]byte, ascii bool) error {
+	r.segments, r.ascii, r.attempts = segments, ascii, nil
+	return r.send()
+}
+
+// send sends the current message till it succeeds or the attempts are exhausted
+func (r *retrySendRecv) send() error {
+	for {
+		start := time.Now()
+		err := r.sr.Send(r.segments, r.ascii)
+		if err == nil {
+			return nil
+		}
+		if !r.retry(start, err, false) {
+			return &RetryError{Attempts: r.attempts, Err: err}
+		}
+	}
+}
+
+// Recv receives and reads the response completely, resending the message on transient failures
+func (r *retrySendRecv) Recv() (*Response, error) {
+	for {
+		start := time.Now()
+		resp, err := r.sr.Recv()
+		if err == nil {
+			if err = resp.readAllSegments(); err == nil {
+				err = resp.statusErr()
+			}
+		}
+		if err == nil {
+			return resp, nil
+		}
+		if !r.retry(start, err, true) {
+			return nil, &RetryError{Attempts: r.attempts, Err: err}
+		}
+		if err = r.send(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Ack acknowledges the response positively
+func (r *retrySendRecv) Ack() error {
+	return r.sr.Ack()
+}
+
+// Nak acknowledges the response negatively
+func (r *retrySendRecv) Nak(reason uint16, retainMsg bool) error {
+	return r.sr.Nak(reason, retainMsg)
+}
+
+// retry records the failed attempt and waits for the next one, if the error can be retried.
+// sent tells that the request is completely written before the failure.
+func (r *retrySendRecv) retry(start time.Time, err error, sent bool) bool {
+	r.attempts = append(r.attempts, Attempt{Start: start, Duration: time.Since(start), Err: err})
+	max := r.policy.MaxAttempts
+	if max <= 0 {
+		max = 3
+	}
+	if len(r.attempts) >= max || !retryable(err, sent, r.idempotent()) {
+		return false
+	}
+	gctx := context.Background()
+	if r.ctx != nil {
+		gctx = r.ctx.goContext()
+	}
+	timer := time.NewTimer(r.policy.backoff(len(r.attempts)))
+	select {
+	case <-timer.C:
+	case <-gctx.Done():
+		timer.Stop()
+		return false
+	}
+	if r.ctx != nil {
+		r.ctx.session.restore(gctx)
+	}
+	return true
+}
+
+// idempotent reports whether the context is marked idempotent
+func (r *retrySendRecv) idempotent() bool {
+	if r.ctx == nil {
+		return false
+	}
+	r.ctx.mu.Lock()
+	defer r.ctx.mu.Unlock()
+	return r.ctx.ident.idempotent
+}
+
+// backoff returns the wait after the given number of failed attempts
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	wait, max := p.Backoff, p.MaxBackoff
+	if wait <= 0 {
+		wait = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// retryable reports whether the failed exchange can be retried. The wrapped errors are
+// classified by the errors they wrap. sent tells that the request is completely written.
+func retryable(err error, sent bool, idempotent bool) bool {
+	var we *WriteError
+	if errors.As(err, &we) {
+		//nothing has left the client yet
+		return we.Written == 0 || idempotent
+	}
+	var ce *IMSConnectError
+	if errors.As(err, &ce) {
+		//the request never reached OTMA
+		if ce.ReturnCode == 44 {
+			return true
+		}
+		if ce.ReturnCode != 16 && (ce.ReasonCode == 72 || ce.ReasonCode == 73 || ce.ReasonCode == 74) {
+			return true
+		}
+		//the socket is disconnected, the request may have been processed
+		return ce.Disconnected() && idempotent
+	}
+	if errors.Is(err, ErrDisconnected) {
+		//the connection is lost before the request, or after it's written
+		return !sent || idempotent
+	}
+	for _, misuse := range []error{ErrContextBusy, ErrAckPending, ErrInvalidState, ErrResponseIncomplete,
+		ErrQueueTimeout, ErrCircuitOpen} {
+		if errors.Is(err, misuse) {
+			//protocol misuse and open circuits are never retried
+			return false
+		}
+	}
+	//read failures after the request is written
+	return idempotent
+}
@@ -0,0 +1,73 @@
+package imstm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err        error
+		sent       bool
+		idempotent bool
+		want       bool
+	}{
+		{&WriteError{Written: 0, Err: errors.New("reset")}, false, false, true},
+		{&WriteError{Written: 10, Err: errors.New("reset")}, false, false, false},
+		{&WriteError{Written: 10, Err: errors.New("reset")}, false, true, true},
+		{fmt.Errorf("send: %w", &WriteError{Written: 0, Err: errors.New("reset")}), false, false, true},
+		{fmt.Errorf("send: %w", &WriteError{Written: 10, Err: errors.New("reset")}), false, false, false},
+		{&IMSConnectError{ReturnCode: 44}, true, false, true},
+		{fmt.Errorf("recv: %w", &IMSConnectError{ReturnCode: 4, ReasonCode: 73}), true, false, true},
+		{&IMSConnectError{ReturnCode: 8, ReasonCode: 72}, true, false, true},
+		{&IMSConnectError{ReturnCode: 16, ReasonCode: 72}, true, false, false},
+		{&IMSConnectError{ReturnCode: 16, ReasonCode: 73}, true, false, false},
+		{&IMSConnectError{ReturnCode: 16, ReasonCode: 74}, true, false, false},
+		{&XAError{Verb: "prepare", Err: &IMSConnectError{ReturnCode: 44}}, true, false, true},
+		{fmt.Errorf("send: %w", ErrDisconnected), false, false, true},
+		{fmt.Errorf("recv: %w", ErrDisconnected), true, false, false},
+		{fmt.Errorf("recv: %w", ErrDisconnected), true, true, true},
+		{fmt.Errorf("send: %w", ErrContextBusy), false, true, false},
+		{fmt.Errorf("send: %w", ErrCircuitOpen), false, true, false},
+		{errors.New("read timeout"), true, false, false},
+		{errors.New("read timeout"), true, true, true},
+	} {
+		if got := retryable(tc.err, tc.sent, tc.idempotent); got != tc.want {
+			t.Errorf("retryable(%v, %v, %v) = %v, want %v", tc.err, tc.sent, tc.idempotent, got, tc.want)
+		}
+	}
+}
+
+func TestRetryBackoffCanceled(t *testing.T) {
+	srv := newFakeServer(t, func(req []byte) []byte {
+		return frame(rsmSeg(4, 72))
+	})
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+
+	gctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	policy := &RetryPolicy{MaxAttempts: 5, Backoff: time.Hour}
+	sr := policy.Wrap(NewContext(sess).SetGoContext(gctx).WithSendRecv(false, false, false))
+	if err := sr.Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sr.Recv()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		var re *RetryError
+		if !errors.As(err, &re) || len(re.Attempts) != 1 {
+			t.Fatalf("got %v, want RetryError after 1 attempt", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backoff outlives the go context")
+	}
+}
@@ -0,0 +1,166 @@
+package imstm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seg returns the LLZZ segment of the data
+func seg(data []byte) []byte {
+	b := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint16(b, uint16(len(b)))
+	copy(b[4:], data)
+	return b
+}
+
+// csmSeg returns the complete status message with the flags
+func csmSeg(msgFlag, protoFlag byte) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b, 12)
+	b[2], b[3] = msgFlag, protoFlag
+	copy(b[4:], A2E([]byte("*CSMOKY*")))
+	return b
+}
+
+// rsmSeg returns the request status message with the return and reason codes
+func rsmSeg(rc, rsn uint32) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b, 20)
+	copy(b[4:], A2E([]byte("*REQSTS*")))
+	binary.BigEndian.PutUint32(b[12:], rc)
+	binary.BigEndian.PutUint32(b[16:], rsn)
+	return b
+}
+
+// frame returns the response message of the segments, prefixed with LLLL
+func frame(segs ...[]byte) []byte {
+	var buf bytes.Buffer
+	n := 4
+	for _, s := range segs {
+		n += len(s)
+	}
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(n))
+	buf.Write(l[:])
+	for _, s := range segs {
+		buf.Write(s)
+	}
+	return buf.Bytes()
+}
+
+// readReq reads a request message, framed by LLLL
+func readReq(r io.Reader) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	b := make([]byte, n)
+	copy(b, l[:])
+	_, err := io.ReadFull(r, b[4:])
+	return b, err
+}
+
+// fakeServer is an IMS connect server on the loopback, serving each request with reply
+type fakeServer struct {
+	l     net.Listener
+	reply func(req []byte) []byte //response to the request, nil for none and empty to hang up
+
+	mu   sync.Mutex
+	reqs [][]byte //requests received
+}
+
+// newFakeServer starts the server. The caller closes it.
+func newFakeServer(t *testing.T, reply func(req []byte) []byte) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fakeServer{l: l, reply: reply}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+// serve serves the requests of the connection
+func (srv *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		req, err := readReq(conn)
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.reqs = append(srv.reqs, req)
+		srv.mu.Unlock()
+		resp := srv.reply(req)
+		if resp != nil && len(resp) == 0 {
+			return
+		}
+		if resp != nil {
+			if _, err := conn.Write(resp); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// requests returns the requests received so far
+func (srv *fakeServer) requests() [][]byte {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([][]byte(nil), srv.reqs...)
+}
+
+// awaitRequests waits for n requests to be received and returns them
+func (srv *fakeServer) awaitRequests(t *testing.T, n int) [][]byte {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reqs := srv.requests()
+		if len(reqs) >= n {
+			return reqs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests received, want %d", len(reqs), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// session starts a session to the server
+func (srv *fakeServer) session(t *testing.T) *Session {
+	sess := &Session{Addr: srv.l.Addr().String()}
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+// Close stops the server
+func (srv *fakeServer) Close() error {
+	return srv.l.Close()
+}
+
+// echo replies to the send-receive and resume tpipe requests with the output, ignoring
+// the acknowledgements
+func echo(out string) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		switch req[35] {
+		case IRMF4SENDRECV, IRMF4RESTPIPE:
+			return frame(seg(A2E([]byte(out))), csmSeg(0, 0))
+		}
+		return nil
+	}
+}
@@ -3,6 +3,8 @@ package imstm
 import (
 	"crypto/tls"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,16 +28,80 @@ type Session struct {
 	// If the value is nil, unsecure connection is established
 	TLSConfig *tls.Config
 
-	// tcp connection
-	conn net.Conn
+	// QueueTimeout enables the queued mode, when set to a positive duration.
+	// In the queued mode, a context that finds the session busy with another context's
+	// exchange waits in line for its turn, up to the timeout, instead of failing with
+	// ErrContextBusy. ErrQueueTimeout is returned if the timeout expires.
+	QueueTimeout time.Duration
+
+	// Reconnect enables the automatic reconnect, when the connection is lost due to a network
+	// error or IMS connect disconnects the socket. If the value is nil, the operations on a lost
+	// connection fail with ErrDisconnected till the session is started again.
+	Reconnect *ReconnectPolicy
+
+	// OnDisconnect, if set, is invoked with the cause when the connection is lost
+	OnDisconnect func(err error)
+
+	// OnReconnect, if set, is invoked after the connection is re-established, with the
+	// number of attempts it took
+	OnReconnect func(attempts int)
+
+	// Observer, if set, observes the events of the session instead of the observer set
+	// by SetObserver
+	Observer Observer
+
+	// Logger, if set, logs the connects, disconnects, exchanges and protocol anomalies
+	Logger Logger
+
+	// WireDump logs every request and response segment in hex and EBCDIC at debug level.
+	// The credentials located by the Exit and the MaskFields are always masked
+	WireDump bool
+
+	// MaskFields are the payload fields masked in the wire dumps
+	MaskFields []MaskField
+
+	// Exit is the user message exit of the IMS connect port. Defaults to HWSSMPL1
+	Exit MessageExit
+
+	// WrapConn, if set, wraps every connection dialed by the session, e.g. to record the
+	// traffic with a Recorder
+	WrapConn func(conn net.Conn) net.Conn
+
+	mu     sync.Mutex   //guards the fields below
+	conn   net.Conn     //tcp connection
+	down   bool         //connection is lost
+	ended  bool         //session is ended by the user
+	state  SessionState //protocol state of the session
+	owner  *Context     //context driving the current exchange
+	queue  []*waiter    //contexts waiting in line for the session
+	events []Event      //events raised under the lock, emitted by unlock
+	dialMu sync.Mutex   //serializes the reconnects
+
+	ep       *endpoint //cluster endpoint of the session, if dialed from a cluster
+	inflight bool      //exchange is counted as outstanding on the endpoint
 }
 
 // Start returns a new connection to the IMS connect host
 func (s *Session) Start() error {
+	conn, err := s.dial()
+	s.mu.Lock()
+	up := !s.downLocked()
+	s.conn = conn
+	s.down = err != nil
+	s.ended = false
+	s.mu.Unlock()
+	if err == nil && !up {
+		s.emit(Event{Type: EventConnect})
+	}
+	return err
+}
+
+// dial connects to the IMS connect host
+func (s *Session) dial() (net.Conn, error) {
 	//validate the string
 	var err error
 	if _, err = net.ResolveTCPAddr("tcp", s.Addr); err != nil {
-		return err
+		return nil, err
 	}
 
 	var dialer net.Dialer = net.Dialer{KeepAlive: -1}
@@ -47,11 +113,34 @@ func (s *Session) Start() error {
 	} else {
 		conn, err = dialer.Dial("tcp", s.Addr)
 	}
-	s.conn = conn
-	return err
+	if err == nil && s.WrapConn != nil {
+		conn = s.WrapConn(conn)
+	}
+	return conn, err
 }
 
 // End ends the session
 func (s *Session) End() error {
-	return s.conn.Close()
+	s.mu.Lock()
+	if !s.downLocked() {
+		s.events = append(s.events, Event{Type: EventDisconnect})
+	}
+	owner := s.owner
+	s.idle()
+	if s.ep != nil && !s.ended {
+		atomic.AddInt32(&s.ep.sessions, -1)
+	}
+	s.down = true
+	s.ended = true
+	conn := s.conn
+	s.unlock()
+
+	//the pending response of the owner is never read
+	if owner != nil {
+		owner.abandon(ErrResponseIncomplete)
+	}
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
 }
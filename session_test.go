@@ -0,0 +1,193 @@
+package imstm
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentContexts(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+	sess.QueueTimeout = 5 * time.Second
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := NewContext(sess).SetTranCode("TRAN")
+			for j := 0; j < 10; j++ {
+				//the identity changes while the context is switched and sending
+				done := make(chan struct{})
+				go func() {
+					ctx.SetCredentials("USER", "GROUP", "PASSWD")
+					ctx.SetClientID("CLIENT")
+					close(done)
+				}()
+				sr := ctx.WithSendRecv(false, false, false)
+				err := sr.Send([][]byte{[]byte("IN")}, true)
+				<-done
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp, err := sr.Recv()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if out, err := resp.Out(true); err != nil || string(out[0]) != "OUT" {
+					t.Error(out, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if st := sess.State(); st != StateIdle {
+		t.Fatalf("state is %v, want Idle", st)
+	}
+	if n := len(srv.requests()); n != 80 {
+		t.Fatalf("%d requests, want 80", n)
+	}
+}
+
+func TestSetCredentials(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+
+	ctx := NewContext(sess)
+	sr := ctx.WithSendRecv(false, false, false)
+	ctx.SetCredentials("USER", "GROUP", "PASSWD")
+	if err := sr.Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sr.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.Out(true); err != nil {
+		t.Fatal(err)
+	}
+	req := srv.requests()[0]
+	for _, f := range []struct {
+		off  int
+		want string
+	}{{60, "USER"}, {68, "GROUP"}, {76, "PASSWD"}} {
+		if got := req[f.off : f.off+8]; !bytes.HasPrefix(got, A2E([]byte(f.want))) {
+			t.Errorf("field at %d is %X, want %s", f.off, got, f.want)
+		}
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+	sess.QueueTimeout = 20 * time.Millisecond
+
+	if err := NewContext(sess).WithSendRecv(false, false, false).Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewContext(sess).WithSendRecv(false, false, false).Send(nil, false); err != ErrQueueTimeout {
+		t.Fatalf("got %v, want ErrQueueTimeout", err)
+	}
+	sess.QueueTimeout = 0
+	if err := NewContext(sess).WithSendRecv(false, false, false).Send(nil, false); err != ErrContextBusy {
+		t.Fatalf("got %v, want ErrContextBusy", err)
+	}
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	var hungUp int32
+	srv := newFakeServer(t, func(req []byte) []byte {
+		if atomic.CompareAndSwapInt32(&hungUp, 0, 1) {
+			return []byte{}
+		}
+		return echo("OUT")(req)
+	})
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+	sess.QueueTimeout = 5 * time.Second
+
+	sr := NewContext(sess).WithSendRecv(false, false, false)
+	if err := sr.Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- NewContext(sess).WithSendRecv(false, false, false).Send(nil, false)
+		}()
+	}
+	for queued := 0; queued < 2; {
+		time.Sleep(time.Millisecond)
+		sess.mu.Lock()
+		queued = len(sess.queue)
+		sess.mu.Unlock()
+	}
+	//the lost connection hands the session over to the waiting contexts, one after another
+	resp, err := sr.Recv()
+	if err == nil {
+		_, err = resp.Out(false)
+	}
+	if err == nil {
+		t.Fatal("read on the hung up connection succeeded")
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != ErrDisconnected {
+			t.Fatalf("got %v, want ErrDisconnected", err)
+		}
+	}
+
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewContext(sess).WithSendRecv(false, false, false).Send(nil, false); err != nil {
+		t.Fatalf("session is not handed over: %v", err)
+	}
+}
+
+func TestObserverUnlocked(t *testing.T) {
+	srv := newFakeServer(t, echo("OUT"))
+	defer srv.Close()
+	sess := srv.session(t)
+
+	//the observer uses the session, which deadlocks if it's invoked under the lock
+	var types []EventType
+	sess.Observer = ObserverFunc(func(ev Event) {
+		ev.Session.State()
+		types = append(types, ev.Type)
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if got := exchangeOut(t, NewContext(sess).WithSendRecv(false, false, false), "IN"); got != "OUT" {
+			t.Errorf("got %q", got)
+		}
+		sess.End()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("observer is invoked under the session lock")
+	}
+	for _, want := range []EventType{EventAcquire, EventRelease, EventDisconnect} {
+		var seen bool
+		for _, typ := range types {
+			seen = seen || typ == want
+		}
+		if !seen {
+			t.Errorf("%v is not observed in %v", want, types)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package imstm
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ErrContextBusy indicates that the session is in the middle of an exchange and the
+// operation or the context switch would corrupt the message stream
+var ErrContextBusy = errors.New("Session is busy with an active context")
+
+// ErrAckPending indicates that the previous output is not yet acknowledged using Ack() or Nak(..)
+var ErrAckPending = errors.New("Acknowledgement pending for the previous output")
+
+// ErrInvalidState indicates that the operation is not allowed in the current session state
+var ErrInvalidState = errors.New("Operation not allowed in the current session state")
+
+// ErrQueueTimeout indicates that the queue timeout expired while waiting in line for the session
+var ErrQueueTimeout = errors.New("Timed out waiting in line for the session")
+
+// SessionState represents the IMS connect protocol state of the session
+type SessionState int
+
+// List of session states
+const (
+	StateIdle             SessionState = iota //no exchange in progress, a context can be switched
+	StateAwaitingResponse                     //request is sent and the response is not completely read
+	StateAwaitingAck                          //output is read and an ACK or NAK is pending
+	StateInConversation                       //an IMS conversation is in progress
+	StateInResumeTpipe                        //resume tpipe is in progress
+)
+
+var stateNames = map[SessionState]string{
+	StateIdle:             "Idle",
+	StateAwaitingResponse: "AwaitingResponse",
+	StateAwaitingAck:      "AwaitingAck",
+	StateInConversation:   "InConversation",
+	StateInResumeTpipe:    "InResumeTpipe",
+}
+
+// String returns the name of the session state
+func (st SessionState) String() string {
+	if str, ok := stateNames[st]; ok {
+		return str
+	}
+	return "Unknown: " + strconv.Itoa(int(st))
+}
+
+// protocol identifies the protocol a context is switched to
+type protocol int
+
+const (
+	protoNone protocol = iota
+	protoSendRecv
+	protoSendOnly
+	protoRecvOnly
+)
+
+// using validates that the context is still switched to the protocol p.
+// err is the error, if any, encountered while switching the context
+func (ctx *Context) using(p protocol, err error) error {
+	if err != nil {
+		return err
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.proto != p {
+		return ErrInvalidState
+	}
+	return nil
+}
+
+// waiter is a context waiting in line for the session in the queued mode
+type waiter struct {
+	ctx     *Context
+	ready   chan struct{} //closed when the session is handed over
+	granted bool          //session is handed over to the waiter
+}
+
+// State returns the current protocol state of the session
+func (s *Session) State() SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// isDown reports whether the connection is lost
+func (s *Session) isDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downLocked()
+}
+
+// downLocked reports whether the connection is lost or never established
+func (s *Session) downLocked() bool {
+	return s.down || s.conn == nil
+}
+
+// connection returns the current connection of the session
+func (s *Session) connection() net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// owned checks if the session can be used by the context and returns the current state
+func (s *Session) owned(ctx *Context) (SessionState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ownedLocked(ctx)
+}
+
+func (s *Session) ownedLocked(ctx *Context) (SessionState, error) {
+	if s.owner != nil && s.owner != ctx {
+		return s.state, ErrContextBusy
+	}
+	return s.state, nil
+}
+
+// switchable checks if the context can switch its protocol. Switching is allowed as long as
+// the context itself is not in the middle of an exchange.
+func (s *Session) switchable(ctx *Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner == ctx && s.state != StateIdle {
+		return ErrContextBusy
+	}
+	return nil
+}
+
+// begin validates the transition for writing a new request from the context.
+// In the queued mode, it waits in line if the session is busy with another context.
+func (s *Session) begin(ctx *Context, proto protocol) error {
+	s.mu.Lock()
+	defer s.unlock()
+	start, active := time.Now(), ctx.active
+	err := s.beginLocked(ctx, proto)
+	if err == ErrContextBusy && s.QueueTimeout > 0 {
+		err = s.wait(ctx, proto)
+	}
+	if err == nil && !active {
+		s.events = append(s.events, Event{Type: EventAcquire, Duration: time.Since(start)})
+	}
+	return err
+}
+
+func (s *Session) beginLocked(ctx *Context, proto protocol) error {
+	state, err := s.ownedLocked(ctx)
+	if err != nil {
+		return err
+	}
+	if s.downLocked() {
+		return ErrDisconnected
+	}
+	switch state {
+	case StateIdle:
+	case StateInConversation:
+		if proto != protoSendRecv {
+			return ErrInvalidState
+		}
+	case StateAwaitingResponse:
+		return ErrResponseIncomplete
+	case StateAwaitingAck:
+		return ErrAckPending
+	default:
+		return ErrInvalidState
+	}
+	//the session stays busy till the request is written
+	s.owner = ctx
+	s.state = StateAwaitingResponse
+	ctx.active = true
+	if s.ep != nil && !s.inflight {
+		s.inflight = true
+		atomic.AddInt32(&s.ep.outstanding, 1)
+	}
+	return nil
+}
+
+// wait queues the context till the session is handed over or the queue timeout expires.
+// It's invoked with the session lock held.
+func (s *Session) wait(ctx *Context, proto protocol) error {
+	w := &waiter{ctx: ctx, ready: make(chan struct{})}
+	s.queue = append(s.queue, w)
+	timer := time.NewTimer(s.QueueTimeout)
+	defer timer.Stop()
+
+	s.mu.Unlock()
+	select {
+	case <-w.ready:
+	case <-timer.C:
+	}
+	s.mu.Lock()
+
+	if w.granted {
+		err := s.beginLocked(ctx, proto)
+		if err != nil {
+			s.idle() //hands the session over to the next in line
+		}
+		return err
+	}
+	for i, qw := range s.queue {
+		if qw == w {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	return ErrQueueTimeout
+}
+
+// sent moves the session to the state after a request is written successfully
+func (s *Session) sent(ctx *Context, proto protocol, expectResponse bool) {
+	s.mu.Lock()
+	defer s.unlock()
+	if s.owner != ctx {
+		return
+	}
+	switch {
+	case proto == protoRecvOnly:
+		s.state = StateInResumeTpipe
+	case expectResponse:
+		s.state = StateAwaitingResponse
+	default:
+		s.idle()
+	}
+}
+
+// receiving validates the transition for reading a response in the context
+func (s *Session) receiving(ctx *Context) error {
+	state, err := s.owned(ctx)
+	if err != nil {
+		return err
+	}
+	if s.isDown() {
+		return ErrDisconnected
+	}
+	switch state {
+	case StateAwaitingResponse, StateInResumeTpipe:
+		return nil
+	case StateAwaitingAck:
+		return ErrAckPending
+	}
+	return ErrInvalidState
+}
+
+// received moves the session to the state after a response is completely read or failed
+func (s *Session) received(ctx *Context, resp *Response, err error) {
+	if cause := lostConn(resp, err); cause != nil {
+		s.disconnect(cause)
+	}
+	if s.ep != nil && err == nil {
+		if serr := resp.statusErr(); unhealthy(serr) {
+			s.ep.cluster.eject(s.ep, serr)
+		}
+	}
+	s.mu.Lock()
+	defer s.unlock()
+	if s.owner != ctx {
+		return
+	}
+	//errors terminate the exchange along with any conversation or resume tpipe
+	if err != nil || resp.rsm != nil {
+		s.idle()
+		return
+	}
+	st := resp.Status()
+	switch {
+	case st.AckRequired:
+		s.state = StateAwaitingAck
+	default:
+		s.settle(resp, st)
+	}
+}
+
+// acking validates the transition for acknowledging the output
+func (s *Session) acking(ctx *Context) error {
+	state, err := s.owned(ctx)
+	if err != nil {
+		return err
+	}
+	if state != StateAwaitingAck {
+		return ErrInvalidState
+	}
+	return nil
+}
+
+// acked moves the session to the state after the output is acknowledged
+func (s *Session) acked(ctx *Context, resp *Response) {
+	s.mu.Lock()
+	defer s.unlock()
+	if s.owner != ctx {
+		return
+	}
+	s.settle(resp, resp.Status())
+}
+
+// settle moves the session to the state after the output is settled
+func (s *Session) settle(resp *Response, st ResponseStatus) {
+	switch {
+	case st.Conversation:
+		s.state = StateInConversation
+	case resp.flow:
+		s.state = StateInResumeTpipe
+	default:
+		s.idle()
+	}
+}
+
+// release releases the session from the context, if it's the owner
+func (s *Session) release(ctx *Context) {
+	s.mu.Lock()
+	defer s.unlock()
+	if s.owner == ctx {
+		s.idle()
+	}
+}
+
+// unlock releases the session lock and emits the events raised under it, so that the
+// observers and loggers never run with the lock held
+func (s *Session) unlock() {
+	events := s.events
+	s.events = nil
+	s.mu.Unlock()
+	for _, ev := range events {
+		s.emit(ev)
+	}
+}
+
+// idle releases the session from the owning context and hands it over to the
+// first context waiting in line, if any. It's invoked with the session lock held, and
+// its events are emitted by unlock.
+func (s *Session) idle() {
+	if s.owner != nil && s.owner.active {
+		s.owner.active = false
+		s.events = append(s.events, Event{Type: EventRelease})
+	}
+	s.state = StateIdle
+	s.owner = nil
+	if s.inflight {
+		s.inflight = false
+		atomic.AddInt32(&s.ep.outstanding, -1)
+	}
+	if len(s.queue) > 0 {
+		w := s.queue[0]
+		s.queue = s.queue[1:]
+		w.granted = true
+		s.owner = w.ctx
+		close(w.ready)
+	}
+}
@@ -0,0 +1,151 @@
+package imstm
+
+import (
+	"strconv"
+	"time"
+)
+
+// CSMF1 constants - flags in the CSM_FLG1 (MsgFlag) field of Complete Status Message
+const (
+	_          byte = 1 << iota //'\x01' reserved
+	_                           //'\x02' reserved
+	_                           //'\x04' reserved
+	_                           //'\x08' reserved
+	_                           //'\x10' reserved
+	CSMF1CONV                   //output belongs to an active IMS conversation
+	CSMF1ASYNC                  //more asynchronous output is available on the tpipe queue
+	CSMF1ACKN                   //ACK or NAK response is required from the client
+)
+
+// CSMPROT constants - flags in the CSM protocol (ProtoFlag) field of Complete Status Message
+const (
+	CSMPROTSYNCNF byte = IRMF3SYNCNF //output is sent with sync level CONFIRM
+	CSMPROTSYNCPT byte = IRMF3SYNCPT //output is sent with sync level SYNCPT
+	CSMPROTCM1    byte = IRMF2CM1    //output is sent in commit mode 1
+	CSMPROTCM0    byte = IRMF2CM0    //output is sent in commit mode 0
+	CSMPROTRESTP  byte = '\x80'      //output is retrieved from the async hold queue
+)
+
+// ResponseStatus represents the metadata of a completely read response message
+type ResponseStatus struct {
+	// Complete indicates that the response message is completely read.
+	// Rest of the fields are reliable only when the response is complete
+	Complete bool
+
+	// MsgFlag and ProtoFlag are the raw CSM flags. Refer to CSMF1 and CSMPROT constants.
+	// The flags decoded into the status are complemented by the request of the output, for the
+	// flags IMS connect doesn't set
+	MsgFlag   byte
+	ProtoFlag byte
+
+	// CM0 indicates that the output is sent in commit-then-send mode
+	CM0 bool
+
+	// Async indicates that the output is retrieved from the async hold queue of the tpipe
+	Async bool
+
+	// MoreAsync indicates that more asynchronous output is available on the tpipe queue
+	MoreAsync bool
+
+	// Conversation indicates that the output belongs to an active IMS conversation
+	Conversation bool
+
+	// AckRequired indicates that an Ack() or Nak(..) is expected for the output
+	AckRequired bool
+
+	// Acknowledged indicates that the output is already acknowledged
+	Acknowledged bool
+
+	// SyncLevel is the sync level the output is sent with
+	SyncLevel SyncLevel
+
+	// Confirmation is the action required from the client to confirm the output
+	Confirmation Confirmation
+
+	// ClientID is the client id generated by IMS connect, if returned
+	ClientID string
+
+	// ModName is the MFS modname from the IOPCB ISRT call, if returned
+	ModName string
+
+	// TimeToFirstByte is the time between the request (or the previous acknowledgement)
+	// and the first byte of the response
+	TimeToFirstByte time.Duration
+
+	// TotalBytes is the total number of bytes read for the response
+	TotalBytes int
+
+	// Segments is the number of data segments in the response
+	Segments int
+}
+
+// Status returns the metadata of the response. Status is complete only after the
+// response is completely read either using Out() or iterating the segments.
+func (r *Response) Status() ResponseStatus {
+	st := ResponseStatus{
+		Complete:     r.done,
+		Acknowledged: r.acked,
+		TotalBytes:   r.totBytes,
+		Segments:     r.dataSegs,
+	}
+	if !r.firstByte.IsZero() {
+		st.TimeToFirstByte = r.firstByte.Sub(r.start)
+	}
+	st.ClientID, _ = r.ClientID()
+	st.ModName, _ = r.ModName()
+	if r.csm != nil {
+		var csm RespCSM
+		(&csm).UnmarshalBinary(r.csm)
+		st.MsgFlag = csm.MsgFlag
+		st.ProtoFlag = csm.ProtoFlag
+		st.CM0 = r.cm0 || csm.ProtoFlag&CSMPROTCM0 != 0
+		st.Async = r.async || csm.ProtoFlag&CSMPROTRESTP != 0
+		st.MoreAsync = csm.MsgFlag&CSMF1ASYNC != 0
+		st.Conversation = r.conv || csm.MsgFlag&CSMF1CONV != 0
+		st.AckRequired = csm.MsgFlag&CSMF1ACKN != 0 || (r.ackExpected && r.dataSegs > 0)
+		switch {
+		case r.syncpt || csm.ProtoFlag&CSMPROTSYNCPT != 0:
+			st.SyncLevel = SyncPoint
+		case r.ackExpected || csm.ProtoFlag&CSMPROTSYNCNF != 0:
+			st.SyncLevel = SyncConfirm
+		}
+		switch {
+		case st.AckRequired && !st.Acknowledged:
+			st.Confirmation = ConfirmAck
+		case st.SyncLevel == SyncPoint && r.dataSegs > 0:
+			st.Confirmation = ConfirmCommit
+		}
+	}
+	return st
+}
+
+// Confirmation is the action required from the client to confirm the output
+type Confirmation int
+
+// Confirmation actions of the output
+const (
+	ConfirmNone   Confirmation = iota //output needs no confirmation
+	ConfirmAck                        //output is confirmed with Ack() or rejected with Nak(..)
+	ConfirmCommit                     //output is confirmed by the commit of the global transaction
+)
+
+// confirmationNames are the names of the confirmation actions
+var confirmationNames = map[Confirmation]string{
+	ConfirmNone:   "None",
+	ConfirmAck:    "Ack",
+	ConfirmCommit: "Commit",
+}
+
+// String returns the name of the confirmation action
+func (c Confirmation) String() string {
+	if str, ok := confirmationNames[c]; ok {
+		return str
+	}
+	return "Unknown: " + strconv.Itoa(int(c))
+}
+
+// Confirmation returns the action required from the client to confirm the output.
+// It's reliable only after the response is completely read.
+func (r *Response) Confirmation() Confirmation {
+	return r.Status().Confirmation
+}
@@ -0,0 +1,133 @@
+package imstm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		flags byte
+		want  ResponseStatus
+	}{
+		{"CM1", nil, 0, ResponseStatus{Complete: true, Segments: 1}},
+		{"CSM", nil, CSMF1CONV | CSMPROTSYNCNF, ResponseStatus{Complete: true,
+			MsgFlag: CSMF1CONV | CSMPROTSYNCNF, ProtoFlag: CSMF1CONV | CSMPROTSYNCNF,
+			Conversation: true, SyncLevel: SyncConfirm, Segments: 1}},
+		{"CM0", []Option{CM0()}, 0, ResponseStatus{Complete: true, CM0: true, AckRequired: true,
+			SyncLevel: SyncConfirm, Confirmation: ConfirmAck, Segments: 1}},
+		{"Conversational", []Option{Conversational()}, 0, ResponseStatus{Complete: true,
+			Conversation: true, Segments: 1}},
+	}
+	for _, test := range tests {
+		srv := newFakeServer(t, func(req []byte) []byte {
+			return frame(seg(A2E([]byte("OUT"))), csmSeg(test.flags, test.flags))
+		})
+		sess := srv.session(t)
+		sr, err := NewContext(sess).SendRecv(test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sr.Send(nil, false); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := sr.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := resp.Out(true); err != nil {
+			t.Fatal(err)
+		}
+		st := resp.Status()
+		st.TimeToFirstByte, st.TotalBytes = 0, 0
+		if st != test.want {
+			t.Errorf("%s: status is %+v, want %+v", test.name, st, test.want)
+		}
+		sess.End()
+		srv.Close()
+	}
+}
+
+func TestStatusFlags(t *testing.T) {
+	tests := []struct {
+		name             string
+		msgFlag, protoFl byte
+		want             ResponseStatus
+	}{
+		{"none", 0, 0, ResponseStatus{}},
+		{"CSMF1CONV", CSMF1CONV, 0, ResponseStatus{Conversation: true}},
+		{"CSMF1ASYNC", CSMF1ASYNC, 0, ResponseStatus{MoreAsync: true}},
+		{"CSMF1ACKN", CSMF1ACKN, 0, ResponseStatus{AckRequired: true, Confirmation: ConfirmAck}},
+		{"CSMPROTSYNCNF", 0, CSMPROTSYNCNF, ResponseStatus{SyncLevel: SyncConfirm}},
+		{"CSMPROTSYNCPT", 0, CSMPROTSYNCPT, ResponseStatus{SyncLevel: SyncPoint,
+			Confirmation: ConfirmCommit}},
+		{"CSMPROTCM1", 0, CSMPROTCM1, ResponseStatus{}},
+		{"CSMPROTCM0", 0, CSMPROTCM0, ResponseStatus{CM0: true}},
+		{"CSMPROTRESTP", 0, CSMPROTRESTP, ResponseStatus{Async: true}},
+	}
+	for _, test := range tests {
+		resp := NewResponse(bytes.NewReader(frame(seg(A2E([]byte("OUT"))),
+			csmSeg(test.msgFlag, test.protoFl))), 0)
+		if _, err := resp.Out(true); err != nil {
+			t.Fatal(err)
+		}
+		want := test.want
+		want.Complete, want.Segments = true, 1
+		want.MsgFlag, want.ProtoFlag = test.msgFlag, test.protoFl
+		st := resp.Status()
+		st.TimeToFirstByte, st.TotalBytes = 0, 0
+		if st != want {
+			t.Errorf("%s: status is %+v, want %+v", test.name, st, want)
+		}
+	}
+}
+
+func TestConversation(t *testing.T) {
+	srv := newFakeServer(t, func(req []byte) []byte {
+		if req[35] == IRMF4DEALLOC {
+			return frame(rsmSeg(0, 97))
+		}
+		return echo("OUT")(req)
+	})
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+
+	ctx := NewContext(sess)
+	if _, err := ctx.SendRecv(CM0(), Conversational()); err == nil {
+		t.Fatal("conversation is allowed with CM0")
+	}
+	sr, err := ctx.SendRecv(Conversational())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := sr.Send(nil, false); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := sr.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := resp.Out(true); err != nil {
+			t.Fatal(err)
+		}
+		if st := sess.State(); st != StateInConversation {
+			t.Fatalf("state is %v, want InConversation", st)
+		}
+	}
+	if err := NewContext(sess).WithSendRecv(false, false, false).Send(nil, false); err != ErrContextBusy {
+		t.Fatalf("got %v, want ErrContextBusy", err)
+	}
+	if err := ctx.End(); err != nil {
+		t.Fatal(err)
+	}
+	if st := sess.State(); st != StateIdle {
+		t.Fatalf("state is %v, want Idle", st)
+	}
+	if reqs := srv.awaitRequests(t, 3); reqs[2][35] != IRMF4DEALLOC {
+		t.Fatalf("F4 is %02X, want DEALLOC", reqs[2][35])
+	}
+}
@@ -0,0 +1,379 @@
+package imstm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// xidLen is the length of the encoded X/Open identifier
+const xidLen = 12 + 128
+
+// XID is the X/Open identifier of a global transaction, as assigned by the transaction manager
+type XID struct {
+	FormatID int32  //format of the identifier, -1 denotes a null XID
+	GTRID    []byte //global transaction id, upto 64 bytes
+	BQUAL    []byte //branch qualifier, upto 64 bytes
+}
+
+// MarshalBinary implements BinaryMarshaler interface to encode the XID in the X/Open layout.
+// The format id and the lengths of the global transaction id and the branch qualifier
+// precede the 128 bytes of data.
+func (x XID) MarshalBinary() ([]byte, error) {
+	if len(x.GTRID) > 64 || len(x.BQUAL) > 64 {
+		return nil, &IRMError{"XID", fmt.Sprintf("%d bytes of gtrid and %d bytes of bqual exceed 64", len(x.GTRID), len(x.BQUAL))}
+	}
+	out := make([]byte, xidLen)
+	binary.BigEndian.PutUint32(out[0:4], uint32(x.FormatID))
+	binary.BigEndian.PutUint32(out[4:8], uint32(len(x.GTRID)))
+	binary.BigEndian.PutUint32(out[8:12], uint32(len(x.BQUAL)))
+	copy(out[12:], x.GTRID)
+	copy(out[12+len(x.GTRID):], x.BQUAL)
+	return out, nil
+}
+
+// UnmarshalBinary implements BinaryUnmarshaler interface to decode the XID
+func (x *XID) UnmarshalBinary(data []byte) error {
+	if len(data) < xidLen {
+		return &IRMError{"XID", fmt.Sprintf("%d bytes are too short", len(data))}
+	}
+	gl, bl := binary.BigEndian.Uint32(data[4:8]), binary.BigEndian.Uint32(data[8:12])
+	if gl > 64 || bl > 64 {
+		return &IRMError{"XID", fmt.Sprintf("%d bytes of gtrid and %d bytes of bqual exceed 64", gl, bl)}
+	}
+	x.FormatID = int32(binary.BigEndian.Uint32(data[0:4]))
+	x.GTRID = append([]byte(nil), data[12:12+gl]...)
+	x.BQUAL = append([]byte(nil), data[12+gl:12+gl+bl]...)
+	return nil
+}
+
+// String returns the XID as format id, gtrid and bqual in hex
+func (x XID) String() string {
+	return fmt.Sprintf("%d:%X:%X", x.FormatID, x.GTRID, x.BQUAL)
+}
+
+// XAVerb is a verb of the two-phase commit protocol of a global transaction
+type XAVerb int
+
+// Verbs of the two-phase commit protocol
+const (
+	XAWork     XAVerb = iota //transaction message under the XID
+	XAPrepare                //first phase of the commit
+	XACommit                 //second phase of the commit
+	XAOnePhase               //commit without the prepare
+	XARollback               //rollback of the branch
+	XARecover                //list of the in-doubt XIDs
+)
+
+// xaVerbNames are the names of the verbs
+var xaVerbNames = map[XAVerb]string{
+	XAWork:     "work",
+	XAPrepare:  "prepare",
+	XACommit:   "commit",
+	XAOnePhase: "commit",
+	XARollback: "rollback",
+	XARecover:  "recover",
+}
+
+// String returns the name of the verb
+func (v XAVerb) String() string {
+	if str, ok := xaVerbNames[v]; ok {
+		return str
+	}
+	return fmt.Sprintf("Unknown: %d", int(v))
+}
+
+// XAExit is a message exit serving the two-phase commit of the global transactions, like
+// HWSJAVA0. The IBM sample exits don't, hence a site specific exit of the port encodes the verbs
+// and the XID as agreed with its IMS connect counterpart.
+type XAExit interface {
+	MessageExit
+
+	// MarshalXA encodes the verb and the XID into the prefix following the IRM header of the
+	// requests flagged with IRMF5XID
+	MarshalXA(verb XAVerb, xid XID) ([]byte, error)
+
+	// UnmarshalXIDs decodes the in-doubt XIDs from the output of XARecover
+	UnmarshalXIDs(out [][]byte) ([]XID, error)
+}
+
+// ErrXAUnsupported indicates that the message exit of the session doesn't implement XAExit
+var ErrXAUnsupported = errors.New("Message exit doesn't support global transactions")
+
+// javaXALen is the length of the XID prefix of HWSJAVA0, i.e. LL, the XA function code,
+// a reserved byte and the XID
+const javaXALen = 4 + xidLen
+
+// javaXAFuncs are the XA function codes of HWSJAVA0 for the verbs
+var javaXAFuncs = map[XAVerb]byte{
+	XAWork:     '\x01',
+	XAPrepare:  '\x02',
+	XACommit:   '\x03',
+	XAOnePhase: '\x04',
+	XARollback: '\x05',
+	XARecover:  '\x06',
+}
+
+// MarshalXA encodes the XID prefix of HWSJAVA0, which is its length LL, the XA function code
+// of the verb, a reserved byte and the XID in the X/Open layout
+func (javaExit) MarshalXA(verb XAVerb, xid XID) ([]byte, error) {
+	fn, ok := javaXAFuncs[verb]
+	if !ok {
+		return nil, &IRMError{"XID", fmt.Sprintf("verb %v is unknown", verb)}
+	}
+	data, err := xid.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 4, javaXALen)
+	binary.BigEndian.PutUint16(out[0:2], javaXALen)
+	out[2] = fn
+	return append(out, data...), nil
+}
+
+// UnmarshalXIDs decodes the in-doubt XIDs of HWSJAVA0, which are sent one after another in the
+// X/Open layout, in one or more segments of the output
+func (javaExit) UnmarshalXIDs(out [][]byte) ([]XID, error) {
+	var xids []XID
+	for _, data := range out {
+		if len(data)%xidLen != 0 {
+			return nil, &IRMError{"XID", fmt.Sprintf("%d bytes aren't a list of XIDs", len(data))}
+		}
+		for off := 0; off < len(data); off += xidLen {
+			var xid XID
+			if err := xid.UnmarshalBinary(data[off : off+xidLen]); err != nil {
+				return nil, err
+			}
+			xids = append(xids, xid)
+		}
+	}
+	return xids, nil
+}
+
+// xaExit returns the message exit of the session serving the global transactions
+func (s *Session) xaExit() (XAExit, error) {
+	if exit, ok := s.exit().(XAExit); ok {
+		return exit, nil
+	}
+	return nil, ErrXAUnsupported
+}
+
+// TxState is the state of a global transaction branch
+type TxState int
+
+// States of a global transaction branch
+const (
+	TxActive     TxState = iota //work is being done under the XID
+	TxPrepared                  //branch is prepared, waiting for the outcome
+	TxCommitted                 //branch is committed
+	TxRolledBack                //branch is rolled back
+)
+
+// txStateNames are the names of the transaction states
+var txStateNames = map[TxState]string{
+	TxActive:     "Active",
+	TxPrepared:   "Prepared",
+	TxCommitted:  "Committed",
+	TxRolledBack: "RolledBack",
+}
+
+// String returns the name of the transaction state
+func (st TxState) String() string {
+	if str, ok := txStateNames[st]; ok {
+		return str
+	}
+	return fmt.Sprintf("Unknown: %d", int(st))
+}
+
+// Tx is a branch of a global transaction, coordinated by an external transaction manager
+// using the two-phase commit. The IMS updates of the transactions sent under the XID are
+// committed or rolled back together with the other resources of the global transaction.
+//
+// The exchanges of a Tx use its context, and the verbs are encoded by the XAExit of the session.
+type Tx struct {
+	ctx *Context
+	xid XID
+
+	mu    sync.Mutex //guards the state
+	state TxState
+}
+
+// Begin starts a branch of the global transaction identified by xid in the context.
+// The transactions are sent under the XID using Tx.SendRecv. It fails with ErrXAUnsupported,
+// unless the exit of the session is an XAExit.
+func (ctx *Context) Begin(xid XID) (*Tx, error) {
+	if _, err := ctx.session.xaExit(); err != nil {
+		return nil, err
+	}
+	if _, err := xid.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	if err := ctx.session.switchable(ctx); err != nil {
+		return nil, err
+	}
+	return &Tx{ctx: ctx, xid: xid}, nil
+}
+
+// XID returns the identifier of the global transaction
+func (tx *Tx) XID() XID {
+	return tx.xid
+}
+
+// State returns the state of the branch
+func (tx *Tx) State() TxState {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.state
+}
+
+// switchTo switches the context into send-recv mode for the verb under the XID
+func (tx *Tx) switchTo(verb XAVerb) (SendReceiver, error) {
+	ctx := tx.ctx
+	sendrecv := &ctxSendRecv{}
+	sendrecv.ctx = ctx
+	if err := ctx.session.switchable(ctx); err != nil {
+		return nil, err
+	}
+	exit, err := ctx.session.xaExit()
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := exit.MarshalXA(verb, tx.xid)
+	if err != nil {
+		return nil, err
+	}
+
+	//initialize irm, retaining the identity of the context
+	irm := ctx.newIRM()
+	irm.F2 = IRMF2CM1 //global transactions commit with send-then-commit
+	irm.F3 = irm.F3 | SyncPoint.flag()
+	irm.F5 = irm.F5 | IRMF5XID //message includes the X/Open identifier
+	irm.F4 = IRMF4SENDRECV
+
+	ctx.switchTo(protoSendRecv, irm)
+	ctx.mu.Lock()
+	ctx.xid = prefix
+	ctx.mu.Unlock()
+	return sendrecv, nil
+}
+
+// SendRecv switches the context into send-recv mode under the XID, with commit mode 1 and
+// sync level SYNCPT. The output needs no acknowledgement, the updates are committed or rolled
+// back by the outcome of the global transaction. It fails with ErrInvalidState once the branch
+// is prepared.
+func (tx *Tx) SendRecv() SendReceiver {
+	tx.mu.Lock()
+	state := tx.state
+	tx.mu.Unlock()
+	if state != TxActive {
+		return &ctxSendRecv{ctx: tx.ctx, err: ErrInvalidState}
+	}
+	sr, err := tx.switchTo(XAWork)
+	if err != nil {
+		return &ctxSendRecv{ctx: tx.ctx, err: err}
+	}
+	return sr
+}
+
+// control sends the xa verb under the XID and returns the output of IMS connect
+func (tx *Tx) control(verb XAVerb) ([][]byte, error) {
+	sr, err := tx.switchTo(verb)
+	if err != nil {
+		return nil, err
+	}
+	if err := sr.Send(nil, false); err != nil {
+		return nil, err
+	}
+	resp, err := sr.Recv()
+	if err != nil {
+		return nil, err
+	}
+	out, err := resp.Out(false)
+	if err != nil {
+		return nil, &XAError{Verb: verb.String(), XID: tx.xid, Err: err}
+	}
+	return out, nil
+}
+
+// transition sends the verb and moves the branch to the next state, when it's in one of the
+// valid states
+func (tx *Tx) transition(verb XAVerb, next TxState, valid ...TxState) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	for _, st := range valid {
+		if tx.state != st {
+			continue
+		}
+		if verb == XACommit && st == TxActive {
+			verb = XAOnePhase
+		}
+		if _, err := tx.control(verb); err != nil {
+			return err
+		}
+		tx.state = next
+		return nil
+	}
+	return ErrInvalidState
+}
+
+// Prepare prepares the branch to commit, as the first phase of the two-phase commit.
+// A failed prepare leaves the branch to be rolled back.
+func (tx *Tx) Prepare() error {
+	return tx.transition(XAPrepare, TxPrepared, TxActive)
+}
+
+// Commit commits the prepared branch. An active branch is committed in a single phase,
+// when the transaction manager optimizes the commit of the only resource.
+func (tx *Tx) Commit() error {
+	return tx.transition(XACommit, TxCommitted, TxActive, TxPrepared)
+}
+
+// Rollback rolls back the active or the prepared branch
+func (tx *Tx) Rollback() error {
+	return tx.transition(XARollback, TxRolledBack, TxActive, TxPrepared)
+}
+
+// Recover returns the XIDs of the branches prepared in IMS, but not yet committed or rolled
+// back, e.g. after a failure of the transaction manager. The in-doubt branches are resolved
+// by committing or rolling back the Tx returned by Resume.
+func (ctx *Context) Recover() ([]XID, error) {
+	exit, err := ctx.session.xaExit()
+	if err != nil {
+		return nil, err
+	}
+	tx := &Tx{ctx: ctx, xid: XID{FormatID: -1}}
+	out, err := tx.control(XARecover)
+	if err != nil {
+		return nil, err
+	}
+	return exit.UnmarshalXIDs(out)
+}
+
+// Resume returns the prepared branch of the in-doubt global transaction identified by xid,
+// as returned by Recover, to be committed or rolled back
+func (ctx *Context) Resume(xid XID) (*Tx, error) {
+	tx, err := ctx.Begin(xid)
+	if err != nil {
+		return nil, err
+	}
+	tx.state = TxPrepared
+	return tx, nil
+}
+
+// XAError is returned when IMS connect fails a two-phase commit verb of a global transaction
+type XAError struct {
+	Verb string //prepare, commit, rollback or recover
+	XID  XID    //identifier of the global transaction
+	Err  error  //error returned by IMS connect
+}
+
+// Error returns the description of the failure
+func (e *XAError) Error() string {
+	return fmt.Sprintf("XA %s of %v failed: %v", e.Verb, e.XID, e.Err)
+}
+
+// Unwrap returns the error returned by IMS connect
+func (e *XAError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,184 @@
+package imstm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// testXAExit prefixes the XID with the verb
+type testXAExit struct {
+	MessageExit
+}
+
+func (testXAExit) MarshalXA(verb XAVerb, xid XID) ([]byte, error) {
+	data, err := xid.MarshalBinary()
+	return append([]byte{byte(verb)}, data...), err
+}
+
+func (testXAExit) UnmarshalXIDs(out [][]byte) ([]XID, error) {
+	xids := make([]XID, len(out))
+	for i, data := range out {
+		if err := xids[i].UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+	}
+	return xids, nil
+}
+
+// xaVerb returns the verb of the request under an XID
+func xaVerb(req []byte) XAVerb {
+	return XAVerb(req[4+int(binary.BigEndian.Uint16(req[4:6]))])
+}
+
+func TestTx(t *testing.T) {
+	xid := XID{FormatID: 1, GTRID: []byte("GTRID"), BQUAL: []byte("BQUAL")}
+	srv := newFakeServer(t, func(req []byte) []byte {
+		if xaVerb(req) == XARecover {
+			data, _ := xid.MarshalBinary()
+			return frame(seg(data), csmSeg(0, 0))
+		}
+		return frame(seg(A2E([]byte("OUT"))), csmSeg(0, 0))
+	})
+	defer srv.Close()
+	sess := srv.session(t)
+	defer sess.End()
+
+	ctx := NewContext(sess)
+	if _, err := ctx.Begin(xid); err != ErrXAUnsupported {
+		t.Fatalf("got %v, want ErrXAUnsupported", err)
+	}
+	sess.Exit = testXAExit{HWSSMPL1}
+	tx, err := ctx.Begin(xid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr := tx.SendRecv()
+	if err := sr.Send(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sr.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.Out(true); err != nil {
+		t.Fatal(err)
+	}
+	if c := resp.Confirmation(); c != ConfirmCommit {
+		t.Fatalf("confirmation is %v, want Commit", c)
+	}
+	if err := tx.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if st := tx.State(); st != TxCommitted {
+		t.Fatalf("state is %v, want Committed", st)
+	}
+	if err := tx.Rollback(); err != ErrInvalidState {
+		t.Fatalf("got %v, want ErrInvalidState", err)
+	}
+
+	reqs := srv.awaitRequests(t, 3)
+	for i, verb := range []XAVerb{XAWork, XAPrepare, XACommit} {
+		req := reqs[i]
+		if got := xaVerb(req); got != verb {
+			t.Errorf("verb is %v, want %v", got, verb)
+		}
+		if req[20]&IRMF5XID == 0 || req[33] != IRMF2CM1 || req[34]&IRMF3SYNCPT == 0 {
+			t.Errorf("%v: F5 %02X, F2 %02X and F3 %02X are not CM1 with SYNCPT under the XID", verb, req[20], req[33], req[34])
+		}
+	}
+
+	xids, err := ctx.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xids) != 1 || xids[0].String() != xid.String() {
+		t.Fatalf("recovered %v, want %v", xids, xid)
+	}
+}
+
+func TestSyncPointOutsideTx(t *testing.T) {
+	ctx := NewContext(&Session{})
+	var ierr *IRMError
+	if err := ctx.WithSyncLevel(SyncPoint, false, false).Send(nil, false); !errors.As(err, &ierr) {
+		t.Fatalf("got %v, want *IRMError", err)
+	}
+	var oerr *OptionError
+	if _, err := ctx.SendRecv(Sync(SyncPoint)); !errors.As(err, &oerr) {
+		t.Fatalf("got %v, want *OptionError", err)
+	}
+	headers := OTMAHeaders{Architecture: 1, SyncLevel: OTMASyncPoint}
+	if err := ctx.WithOTMA(headers).Send(nil, false); !errors.As(err, &ierr) || ierr.Field != "OTMA sync level" {
+		t.Fatalf("got %v, want *IRMError of the OTMA sync level", err)
+	}
+}
+
+func TestJavaXA(t *testing.T) {
+	xid := XID{FormatID: 0x10, GTRID: []byte{0xA1, 0xA2}, BQUAL: []byte{0xB1}}
+	other := XID{FormatID: 0x20, GTRID: []byte("G"), BQUAL: []byte("B")}
+	srv := newFakeServer(t, func(req []byte) []byte {
+		if off := 4 + int(binary.BigEndian.Uint16(req[4:6])); req[off+2] == '\x06' {
+			a, _ := xid.MarshalBinary()
+			b, _ := other.MarshalBinary()
+			return frame(seg(append(a, b...)), csmSeg(0, 0))
+		}
+		return echo("OUT")(req)
+	})
+	defer srv.Close()
+	sess := &Session{Addr: srv.l.Addr().String(), Exit: HWSJAVA0}
+	if err := sess.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sess.End()
+
+	ctx := NewContext(sess)
+	tx, err := ctx.Begin(xid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := exchangeOut(t, tx.SendRecv(), "IN"); got != "OUT" {
+		t.Fatalf("got %q", got)
+	}
+	if err := tx.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	xids, err := ctx.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xids) != 2 || xids[0].String() != xid.String() || xids[1].String() != other.String() {
+		t.Fatalf("recovered %v, want [%v %v]", xids, xid, other)
+	}
+
+	//the XID prefix is LL, the function code, a reserved byte and the X/Open XID
+	xidData := make([]byte, xidLen)
+	copy(xidData, []byte{0, 0, 0, 0x10, 0, 0, 0, 2, 0, 0, 0, 1, 0xA1, 0xA2, 0xB1})
+	reqs := srv.awaitRequests(t, 4)
+	for i, fn := range []byte{'\x01', '\x02', '\x05', '\x06'} {
+		req := reqs[i]
+		off := 4 + int(binary.BigEndian.Uint16(req[4:6]))
+		if !bytes.Equal(req[8:16], A2E([]byte("*IRMREQ*"))) {
+			t.Errorf("%d: irm id is %X", i, req[8:16])
+		}
+		want := append([]byte{0, 144, fn, 0}, xidData...)
+		if fn == '\x06' {
+			want = append([]byte{0, 144, fn, 0, 0xFF, 0xFF, 0xFF, 0xFF}, make([]byte, xidLen-4)...)
+		}
+		if got := req[off : off+144]; !bytes.Equal(got, want) {
+			t.Errorf("%d: prefix is\n%X\nwant\n%X", i, got, want)
+		}
+		if n := HWSJAVA0.(PrefixExit).PrefixLen(req); n != 144 {
+			t.Errorf("%d: prefix length is %d, want 144", i, n)
+		}
+	}
+	if segs := frameSegments(HWSJAVA0, reqs[0]); len(segs) != 1 || !bytes.Equal(segs[0], A2E([]byte("IN"))) {
+		t.Errorf("segments of the work request are %X", segs)
+	}
+}